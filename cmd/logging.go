@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// newLogger builds the logger selected by --log-level and --log-format, writing records to w.
+func newLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var minimum slog.Level
+	if err := minimum.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("log level: %w", err)
+	}
+	handlerOptions := &slog.HandlerOptions{Level: minimum}
+	switch format {
+	case logFormatText:
+		return slog.New(slog.NewTextHandler(w, handlerOptions)), nil
+	case logFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, handlerOptions)), nil
+	default:
+		return nil, fmt.Errorf("expected log format %s or %s, got %q", logFormatText, logFormatJSON, format)
+	}
+}
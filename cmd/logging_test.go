@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNewLoggerFiltersByLevel(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := newLogger(&output, "warn", logFormatJSON)
+	require.NoError(t, err)
+	logger.Info("hidden")
+	logger.With("collector", "iftop").Warn("shown", "iface", "igb0")
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(output.Bytes(), &record))
+	assert.Equal(t, "shown", record["msg"])
+	assert.Equal(t, "iftop", record["collector"])
+	assert.Equal(t, "igb0", record["iface"])
+}
+
+func TestNewLoggerRejectsUnknownSettings(t *testing.T) {
+	_, err := newLogger(&bytes.Buffer{}, "loud", logFormatText)
+	assert.Error(t, err)
+	_, err = newLogger(&bytes.Buffer{}, "info", "xml")
+	assert.Error(t, err)
+}
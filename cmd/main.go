@@ -1,15 +1,214 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/engine"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/flows"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/iftop"
 	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/netstat"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
 )
 
 type options struct {
-	pfsenseAddress   string
-	pfsenseUser      string
-	pfsensePassword  string
-	networkInterface string
+	logLevel                 string
+	logFormat                string
+	transport                string
+	recordDir                string
+	replayDir                string
+	replaySpeed              float64
+	pfsenseAddress           string
+	pfsensePort              int
+	pfsenseUser              string
+	pfsensePassword          string
+	privateKeyFile           string
+	privateKeyPassphraseFile string
+	agentSocket              string
+	knownHostsFile           string
+	trustOnFirstUse          bool
+	hostKeyFingerprint       string
+	insecureHostKey          bool
+	jumpHostSpecs            []string
+	jumpHosts                []engine.JumpHost
+	keepAliveInterval        time.Duration
+	frameTimeout             time.Duration
+	iftopUnitBase            iftop.UnitBase
+	networkInterfaces        []string
+	iftop                    engine.IftopOptions
+	restartPolicy            engine.RestartPolicy
+	flowTTL                  time.Duration
+	maxFlows                 int
+	topFlows                 int
+	aggregations             []string
+	localNetworkSpecs        []string
+
+	// surveyed is the netstat reading interfaces and local networks are discovered from, taken once when first needed.
+	surveyed []*netstat.IFaceReading
+}
+
+func (o *options) engineConfig() engine.Config {
+	return engine.Config{
+		Transport:                o.transport,
+		RecordDir:                o.recordDir,
+		ReplayDir:                o.replayDir,
+		ReplaySpeed:              o.replaySpeed,
+		PfsenseUser:              o.pfsenseUser,
+		PfsenseAddress:           o.pfsenseAddress,
+		PfsensePort:              o.pfsensePort,
+		PfsensePassword:          o.pfsensePassword,
+		PrivateKeyFile:           o.privateKeyFile,
+		PrivateKeyPassphraseFile: o.privateKeyPassphraseFile,
+		AgentSocket:              o.agentSocket,
+		KnownHostsFile:           o.knownHostsFile,
+		TrustOnFirstUse:          o.trustOnFirstUse,
+		HostKeyFingerprint:       o.hostKeyFingerprint,
+		InsecureIgnoreHostKey:    o.insecureHostKey,
+		JumpHosts:                o.jumpHosts,
+		KeepAliveInterval:        o.keepAliveInterval,
+		FrameTimeout:             o.frameTimeout,
+		IftopUnitBase:            o.iftopUnitBase,
+		Iftop:                    o.iftop,
+	}
+}
+
+// addConnectionFlags registers the flags describing how to reach and authenticate against pfSense.
+func addConnectionFlags(flags *pflag.FlagSet, config *options) {
+	flags.StringVar(&config.transport, "transport", engine.TransportSSH, "How to run commands: ssh to reach pfsense remotely, local when running on the firewall, or replay to play back --replay captures")
+	flags.StringVar(&config.recordDir, "record", "", "Directory to record raw command output into for later replay")
+	flags.StringVar(&config.replayDir, "replay", "", "Directory of recorded captures played back by the replay transport")
+	flags.Float64Var(&config.replaySpeed, "replay-speed", 1, "Pace of replayed captures relative to when they were recorded; 0 replays as fast as possible")
+	flags.StringVarP(&config.pfsenseAddress, "pfsense-address", "p", "192.168.100.1", "Address of pfsense")
+	flags.IntVar(&config.pfsensePort, "pfsense-port", 22, "SSH port of pfsense")
+	flags.StringVarP(&config.pfsenseUser, "pfsense-user", "u", "root", "Username of pfsense")
+	flags.StringVarP(&config.pfsensePassword, "pfsense-password", "s", "", "Password of pfsense; tried after agent and private key authentication")
+	flags.StringVar(&config.privateKeyFile, "private-key", "", "Private key file used to authenticate with pfsense; tried after the ssh agent")
+	flags.StringVar(&config.privateKeyPassphraseFile, "private-key-passphrase-file", "", "File holding the passphrase of an encrypted private key")
+	flags.StringVar(&config.agentSocket, "ssh-agent-socket", "", "ssh-agent socket (e.g. $SSH_AUTH_SOCK); tried first")
+	flags.StringVar(&config.knownHostsFile, "known-hosts", "", "known_hosts file used to verify the pfsense host key")
+	flags.BoolVar(&config.trustOnFirstUse, "trust-on-first-use", false, "Record the pfsense host key in --known-hosts when it is not yet listed")
+	flags.StringVar(&config.hostKeyFingerprint, "host-key-fingerprint", "", "Pinned SHA256 fingerprint of the pfsense host key; takes precedence over --known-hosts")
+	flags.BoolVar(&config.insecureHostKey, "insecure-ignore-host-key", false, "Skip verification of the pfsense host key")
+	flags.StringArrayVarP(&config.jumpHostSpecs, "jump-host", "J", nil, "Jump host to tunnel through as [user@]host[:port][,identity=FILE][,passphrase-file=FILE][,password-file=FILE][,agent=SOCKET][,fingerprint=SHA256:...]; repeat for several hops")
+	flags.DurationVar(&config.keepAliveInterval, "ssh-keepalive", 15*time.Second, "Interval between SSH keepalive probes; 0 disables them")
+	flags.StringSliceVarP(&config.networkInterfaces, "network-interface", "n", []string{"ixgb0"}, "Network interfaces to watch, repeated or comma separated; all watches every interface which is up")
+}
+
+// survey takes a netstat reading to discover interfaces and local networks from, without recording it or consuming a
+// replayed one.  The reading is taken once, however many things are discovered from it.
+func (o *options) survey(ctx context.Context) ([]*netstat.IFaceReading, error) {
+	if o.surveyed == nil {
+		readings, err := netstat.NewNetstat(&netstat.Config{Config: o.engineConfig()}).Survey(ctx)
+		if err != nil {
+			return nil, err
+		}
+		o.surveyed = readings
+	}
+	return o.surveyed, nil
+}
+
+// allInterfaces requests every interface netstat reports as up be watched.
+const allInterfaces = "all"
+
+// interfaces resolves the interfaces to watch, discovering them with netstat when all are requested.
+func (o *options) interfaces(ctx context.Context) ([]string, error) {
+	if !slices.Contains(o.networkInterfaces, allInterfaces) {
+		return o.networkInterfaces, nil
+	}
+	readings, err := o.survey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("discovering interfaces: %w", err)
+	}
+	names := netstat.Interfaces(readings)
+	if len(names) == 0 {
+		return nil, errors.New("netstat reported no interfaces to watch")
+	}
+	return names, nil
+}
+
+// autoLocalNetworks asks for the networks netstat reports on the watched interfaces to be local.
+const autoLocalNetworks = "auto"
+
+// localNetworks resolves the networks local hosts are on, asking netstat for those on the watched interfaces when auto
+// is given.  Without any networks,
+// hosts with private addresses are taken to be local.
+func (o *options) localNetworks(ctx context.Context) (flows.LocalNetworks, error) {
+	specs := slices.DeleteFunc(slices.Clone(o.localNetworkSpecs), func(spec string) bool {
+		return spec == autoLocalNetworks
+	})
+	local, err := flows.ParseLocalNetworks(specs)
+	if err != nil {
+		return nil, err
+	}
+	if len(specs) == len(o.localNetworkSpecs) {
+		return local, nil
+	}
+	interfaces, err := o.interfaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	readings, err := o.survey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("discovering local networks: %w", err)
+	}
+	networks := netstat.Networks(readings, interfaces)
+	if len(networks) == 0 {
+		return nil, errors.New("netstat reported no local networks")
+	}
+	return append(local, networks...), nil
+}
+
+// unitBaseFlag selects the unit scaling used by iftop by name.
+type unitBaseFlag struct {
+	base *iftop.UnitBase
+}
+
+func (u unitBaseFlag) String() string {
+	if *u.base == iftop.DecimalUnits {
+		return "decimal"
+	}
+	return "binary"
+}
+
+func (u unitBaseFlag) Set(value string) error {
+	switch value {
+	case "binary":
+		*u.base = iftop.BinaryUnits
+	case "decimal":
+		*u.base = iftop.DecimalUnits
+	default:
+		return fmt.Errorf("expected binary or decimal, got %q", value)
+	}
+	return nil
+}
+
+func (u unitBaseFlag) Type() string {
+	return "units"
+}
+
+// addIftopFlags registers the flags controlling how iftop is run and restarted.
+func addIftopFlags(flags *pflag.FlagSet, config *options) {
+	config.iftopUnitBase = iftop.BinaryUnits
+	flags.Var(unitBaseFlag{base: &config.iftopUnitBase}, "iftop-units", "Scaling between iftop's unit prefixes: binary (1024) or decimal (1000)")
+	defaults := engine.DefaultRestartPolicy()
+	config.restartPolicy = defaults
+	flags.DurationVar(&config.restartPolicy.InitialBackoff, "restart-initial-backoff", defaults.InitialBackoff, "Delay before restarting a failed iftop stream")
+	flags.DurationVar(&config.restartPolicy.MaxBackoff, "restart-max-backoff", defaults.MaxBackoff, "Maximum delay between iftop restarts")
+	flags.DurationVar(&config.frameTimeout, "iftop-frame-timeout", 30*time.Second, "Restart iftop when no complete frame arrives within this long; 0 waits forever")
+	flags.IntVar(&config.restartPolicy.MaxAttempts, "restart-max-attempts", defaults.MaxAttempts, "Consecutive iftop failures tolerated before giving up; 0 retries forever")
+	flags.StringVar(&config.iftop.Filter, "iftop-filter", "", "pcap filter expression selecting the traffic iftop counts, e.g. 'not port 873'")
+	flags.StringVar(&config.iftop.NetFilter, "iftop-net-filter", "", "Only count traffic entering or leaving this IPv4 network, e.g. 192.168.1.0/24")
+	flags.StringVar(&config.iftop.NetFilter6, "iftop-net-filter6", "", "Only count traffic entering or leaving this IPv6 network, e.g. 2001:db8::/64")
+	flags.IntVar(&config.iftop.LineLimit, "iftop-line-limit", engine.DefaultIftopLineLimit, "Maximum flows reported by iftop per frame")
+	flags.StringVar(&config.iftop.SortBy, "iftop-sort", "", "Column iftop sorts flows by: 2s, 10s, 40s, source or destination")
+	flags.BoolVar(&config.iftop.Promiscuous, "iftop-promiscuous", false, "Count traffic passing through the interface which is not addressed to the firewall")
 }
 
 func main() {
@@ -21,57 +220,69 @@ func main() {
 		Short: "Text user interface to watch bandwidth usage",
 		Args:  cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return tuiMain(config)
+			return tuiMain(cmd.Context(), config)
 		},
 	}
-	tuiFlags := tui.PersistentFlags()
-	tuiFlags.StringVarP(&config.pfsenseAddress, "pfsense-address", "p", "192.168.100.1", "Address of pfsense")
-	tuiFlags.StringVarP(&config.pfsenseUser, "pfsense-user", "u", "root", "Username of pfsense")
-	tuiFlags.StringVarP(&config.pfsensePassword, "pfsense-password", "s", "", "Password of pfsense")
-	tuiFlags.StringVarP(&config.networkInterface, "network-interface", "n", "ixgb0", "Network interface")
+	addConnectionFlags(tui.PersistentFlags(), config)
+	addIftopFlags(tui.PersistentFlags(), config)
 
 	service := &cobra.Command{
 		Use:   "service",
 		Short: "Service to export scrapped data for prometheus",
 		Args:  cobra.MinimumNArgs(0),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runService(config)
+			return runService(cmd.Context(), config)
 		},
 	}
-	serviceFlags := service.PersistentFlags()
-	serviceFlags.StringVarP(&config.pfsenseAddress, "pfsense-address", "p", "192.168.100.1", "Address of pfsense")
-	serviceFlags.StringVarP(&config.pfsenseUser, "pfsense-user", "u", "root", "Username of pfsense")
-	serviceFlags.StringVarP(&config.pfsensePassword, "pfsense-password", "s", "", "Password of pfsense")
-	serviceFlags.StringVarP(&config.networkInterface, "network-interface", "n", "ixgb0", "Network interface")
+	addConnectionFlags(service.PersistentFlags(), config)
+	addIftopFlags(service.PersistentFlags(), config)
+	service.PersistentFlags().DurationVar(&config.flowTTL, "flow-ttl", 5*time.Minute, "Stop exporting flows absent from iftop for this long; 0 exports them forever")
+	service.PersistentFlags().IntVar(&config.maxFlows, "max-flows", 10000, "Maximum flows tracked per interface, dropping the least recently seen; 0 is unlimited")
+	service.PersistentFlags().IntVar(&config.topFlows, "top-flows", 250, "Flows exported individually per interface, ranked by bytes transferred; the rest are summed into an other flow. 0 exports every flow")
+	service.PersistentFlags().StringSliceVar(&config.aggregations, "aggregation", []string{flows.ModeFlow}, "How flows are aggregated for export: flow, host-pair, local-host and/or local-remote, repeated or comma separated")
+	service.PersistentFlags().StringSliceVar(&config.localNetworkSpecs, "local-network", nil, "Networks of local hosts as CIDRs, or auto for those netstat reports on the watched interfaces; hosts with private addresses when unset")
 
 	netstatCmd := &cobra.Command{
 		Use:  "netstat",
 		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			netstat := netstat.NewNetstat(&netstat.Config{
-				PfsenseUser:      config.pfsenseUser,
-				PfsenseAddress:   config.pfsenseAddress,
-				PfsensePassword:  config.pfsensePassword,
-				NetworkInterface: config.networkInterface,
+				Config: config.engineConfig(),
 			})
 			return netstat.TextUIOnce(cmd.Context())
 		},
 	}
-	netstatFlag := netstatCmd.PersistentFlags()
-	netstatFlag.StringVarP(&config.pfsenseAddress, "pfsense-address", "p", "192.168.100.1", "Address of pfsense")
-	netstatFlag.StringVarP(&config.pfsenseUser, "pfsense-user", "u", "root", "Username of pfsense")
-	netstatFlag.StringVarP(&config.pfsensePassword, "pfsense-password", "s", "", "Password of pfsense")
-	netstatFlag.StringVarP(&config.networkInterface, "network-interface", "n", "ixgb0", "Network interface")
+	addConnectionFlags(netstatCmd.PersistentFlags(), config)
 
 	root := &cobra.Command{
 		Use:   "pfbandwidth",
 		Short: "Connects to a pfSense box and pulls bandwidth usage according to iftop",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			logger, err := newLogger(os.Stderr, config.logLevel, config.logFormat)
+			if err != nil {
+				return err
+			}
+			slog.SetDefault(logger)
+			for _, spec := range config.jumpHostSpecs {
+				hop, err := engine.ParseJumpHost(spec, config.pfsenseUser)
+				if err != nil {
+					return err
+				}
+				config.jumpHosts = append(config.jumpHosts, hop)
+			}
+			return nil
+		},
 	}
+	root.PersistentFlags().StringVar(&config.logLevel, "log-level", "info", "Minimum level of logs written to stderr: debug, info, warn or error")
+	root.PersistentFlags().StringVar(&config.logFormat, "log-format", logFormatText, "Format of logs written to stderr: text or json")
 	root.AddCommand(tui)
 	root.AddCommand(netstatCmd)
 	root.AddCommand(service)
 
-	if err := root.Execute(); err != nil {
+	// cancelling stops the remote commands rather than leaving them running on pfSense
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := root.ExecuteContext(ctx); err != nil {
 		panic(err)
 	}
 }
@@ -2,77 +2,97 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/engine"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/flows"
 	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/iftop"
 	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/netstat"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
 	"net/http"
 )
 
-var frames = promauto.NewCounter(prometheus.CounterOpts{
-	Name: "iftop_readings",
+var frames = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "iftop_readings_total",
 	Help: "A full reading from the remote iftop instance",
-})
+}, []string{"iface"})
 
-func runService(config *options) error {
+func runService(ctx context.Context, config *options) error {
+	interfaces, err := config.interfaces(ctx)
+	if err != nil {
+		return err
+	}
+	failed := make(chan error, len(interfaces)+2)
+	if err := startCollectors(ctx, config, interfaces, prometheus.DefaultRegisterer, failed); err != nil {
+		return err
+	}
 	go func() {
-		gauges := make(map[string]prometheus.Gauge)
-		err := engine.Run(context.Background(), &engine.Config{
-			PfsenseUser:      config.pfsenseUser,
-			PfsenseAddress:   config.pfsenseAddress,
-			PfsensePassword:  config.pfsensePassword,
-			NetworkInterface: config.networkInterface,
-		}, func(ctx context.Context, reading *iftop.Reading, interpreter *iftop.IftopInterpreter) error {
-			frames.Add(1)
-			for _, f := range reading.Frames {
-				k := f.Source.Address + f.Destination.Address
-				if g, ok := gauges[k]; ok {
-					g.Set(f.Source.Cumulative.ToFloat64())
-				} else {
-					labels := make(prometheus.Labels)
-					source := f.Source.AddressParts()
-					labels["src_host"] = source.Host
-					labels["src_port"] = source.Port
-
-					destination := f.Destination.AddressParts()
-					labels["dst_host"] = destination.Host
-					labels["dst_port"] = destination.Port
-					labels["iface"] = config.networkInterface
-					g := promauto.NewGauge(prometheus.GaugeOpts{
-						Name:        "bandwidth",
-						Help:        "in bytes",
-						ConstLabels: labels,
-					})
-					gauges[k] = g
-					g.Set(f.Source.Cumulative.ToFloat64())
-				}
-			}
-			return nil
-		})
-		if err != nil {
-			panic(err)
-		}
+		slog.Info("exporting prometheus metrics", "address", ":2112")
+		http.Handle("/metrics", promhttp.Handler())
+		failed <- http.ListenAndServe(":2112", nil)
 	}()
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-failed:
+		return err
+	}
+}
 
+// startCollectors registers the exported metrics with registerer then runs an iftop collector for each interface and
+// the netstat collector in the background, reporting failures they can not recover from on failed.  failed must be able
+// to buffer a failure from every collector.
+func startCollectors(ctx context.Context, config *options, interfaces []string, registerer prometheus.Registerer, failed chan<- error) error {
+	localNetworks, err := config.localNetworks(ctx)
+	if err != nil {
+		return err
+	}
+	flowCollector, err := flows.NewCollector(flows.CollectorConfig{
+		TTL:           config.flowTTL,
+		MaxFlows:      config.maxFlows,
+		TopFlows:      config.topFlows,
+		Modes:         config.aggregations,
+		LocalNetworks: localNetworks,
+	})
+	if err != nil {
+		return err
+	}
 	networkStats := netstat.NewNetstat(&netstat.Config{
-		PfsenseUser:      config.pfsenseUser,
-		PfsenseAddress:   config.pfsenseAddress,
-		PfsensePassword:  config.pfsensePassword,
-		NetworkInterface: config.networkInterface,
+		Config: config.engineConfig(),
 	})
+	for _, collector := range []prometheus.Collector{flowCollector, networkStats.Collector()} {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+
+	for _, iface := range interfaces {
+		go func() {
+			defer flowCollector.Forget(iface)
+			if err := collectInterface(ctx, config, iface, flowCollector); !errors.Is(err, engine.ErrReplayExhausted) {
+				failed <- fmt.Errorf("iftop(%s): %w", iface, err)
+			}
+		}()
+	}
 	go func() {
-		err := networkStats.RunService(context.Background())
-		if err != nil {
-			panic(err)
+		if err := networkStats.RunService(ctx); !errors.Is(err, engine.ErrReplayExhausted) {
+			failed <- fmt.Errorf("netstat: %w", err)
 		}
 	}()
-	fmt.Printf("Exporting prometheus service on :2112\n")
-	http.Handle("/metrics", promhttp.Handler())
-	if err := http.ListenAndServe(":2112", nil); err != nil {
-		panic(err)
-	}
 	return nil
 }
+
+// collectInterface records the flows iftop reports on iface until the stream can not be recovered.  Streams for every
+// interface share the same SSH connection.
+func collectInterface(ctx context.Context, config *options, iface string, flowCollector *flows.Collector) error {
+	engineConfig := config.engineConfig()
+	engineConfig.NetworkInterface = iface
+	return engine.Supervise(ctx, &engineConfig, config.restartPolicy, func(ctx context.Context, reading *iftop.Reading, interpreter *iftop.IftopInterpreter) error {
+		frames.WithLabelValues(iface).Inc()
+		flowCollector.Record(iface, reading)
+		return nil
+	})
+}
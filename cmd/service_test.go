@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/engine"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/pfsensetest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var iftopOutput = []string{
+	"Listening on igb0",
+	"   # Host name (port/service if enabled)            last 2s   last 10s   last 40s cumulative",
+	"--------------------------------------------------------------------------------------------",
+	"   1 192.168.1.10:51234                       =>     1.25KB     1.10KB     1.10KB     2.75KB",
+	"     142.250.72.14:443                        <=     15.2KB     12.4KB     12.4KB     31.0KB",
+	"   2 192.168.1.22:22                          =>       312B       298B       298B       745B",
+	"     192.168.1.5:60001                        <=       208B       190B       190B       475B",
+	"   3 2001:db8::10:51234                       =>       512B       512B       512B     1.00KB",
+	"     2606:4700:4700::1111:443                 <=     2.00KB     2.00KB     2.00KB     4.00KB",
+	"--------------------------------------------------------------------------------------------",
+	"Total send rate:                                     1.55KB     1.39KB     1.39KB",
+	"Total receive rate:                                  15.4KB     12.6KB     12.6KB",
+	"Total send and receive rate:                         17.0KB     14.0KB     14.0KB",
+	"--------------------------------------------------------------------------------------------",
+	"Peak rate (sent/received/total):                     1.55KB     15.4KB     17.0KB",
+	"Cumulative (sent/received/total):                    3.49KB     31.5KB     35.0KB",
+	"============================================================================================",
+	"",
+}
+
+var netstatOutput = []string{
+	"Name       Mtu Network             Address                               Ipkts Ierrs Idrop         Ibytes       Opkts Oerrs         Obytes  Coll  Drop",
+	"igb0      1500 <Link#1>            00:90:0b:7c:06:00                1455471621     2     0  1773036112075   473397831    11   124176101655     3     7",
+	"igb0         - 192.168.1.0/24      192.168.1.1                          1024     -     -          65536        2048     -         131072     -     -",
+	"igb1      1500 <Link#2>            00:90:0b:7c:06:01                  104857     0     0      104857600       52428     0       52428800     0     0",
+	"igb1         - 203.0.113.0/24      203.0.113.7                          2048     -     -         262144        1024     -          65536     -     -",
+	"igb2*     1500 <Link#3>            00:90:0b:7c:06:02                       0     0     0              0           0     0              0     0     0",
+	"lo0      16384 <Link#4>            lo0                                  4096     0     0         409600        4096     0         409600     0     0",
+	"pflog0   33160 <Link#5>            pflog0                                  0     0     0              0           0     0              0     0     0",
+}
+
+func scrape(t *testing.T, registry *prometheus.Registry) string {
+	recorder := httptest.NewRecorder()
+	handler := promhttp.HandlerFor(prometheus.Gatherers{registry, prometheus.DefaultGatherer}, promhttp.HandlerOpts{})
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return recorder.Body.String()
+}
+
+func TestDiscoveryTakesOneNetstatReading(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	server.Handle("netstat", pfsensetest.Command{Stdout: netstatOutput})
+	serverConfig := server.Config()
+	config := &options{
+		transport:          engine.TransportSSH,
+		pfsenseAddress:     serverConfig.PfsenseAddress,
+		pfsensePort:        serverConfig.PfsensePort,
+		pfsenseUser:        serverConfig.PfsenseUser,
+		pfsensePassword:    serverConfig.PfsensePassword,
+		hostKeyFingerprint: serverConfig.HostKeyFingerprint,
+		networkInterfaces:  []string{allInterfaces},
+		localNetworkSpecs:  []string{autoLocalNetworks},
+	}
+
+	interfaces, err := config.interfaces(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"igb0", "igb1"}, interfaces)
+	local, err := config.localNetworks(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, local.Contains("192.168.1.10"))
+	assert.False(t, local.Contains("10.0.0.1"))
+	assert.Equal(t, []string{"netstat -ibdnW"}, server.Executed(), "interfaces and local networks are discovered from one reading")
+}
+
+func TestAutoLocalNetworksFollowWatchedInterfaces(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	server.Handle("netstat", pfsensetest.Command{Stdout: netstatOutput})
+	serverConfig := server.Config()
+	config := &options{
+		transport:          engine.TransportSSH,
+		pfsenseAddress:     serverConfig.PfsenseAddress,
+		pfsensePort:        serverConfig.PfsensePort,
+		pfsenseUser:        serverConfig.PfsenseUser,
+		pfsensePassword:    serverConfig.PfsensePassword,
+		hostKeyFingerprint: serverConfig.HostKeyFingerprint,
+		networkInterfaces:  []string{"igb0"},
+		localNetworkSpecs:  []string{autoLocalNetworks},
+	}
+
+	local, err := config.localNetworks(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, local.Contains("192.168.1.10"))
+	assert.False(t, local.Contains("203.0.113.9"), "the network of the unwatched igb1 is not local")
+}
+
+func TestServiceExportsCollectedMetrics(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	server.Handle("iftop", pfsensetest.Command{Stdout: iftopOutput, Hold: true})
+	server.Handle("netstat", pfsensetest.Command{Stdout: netstatOutput})
+	serverConfig := server.Config()
+
+	config := &options{
+		transport:          engine.TransportSSH,
+		pfsenseAddress:     serverConfig.PfsenseAddress,
+		pfsensePort:        serverConfig.PfsensePort,
+		pfsenseUser:        serverConfig.PfsenseUser,
+		pfsensePassword:    serverConfig.PfsensePassword,
+		hostKeyFingerprint: serverConfig.HostKeyFingerprint,
+		networkInterfaces:  []string{allInterfaces},
+		restartPolicy:      engine.DefaultRestartPolicy(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interfaces, err := config.interfaces(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"igb0", "igb1"}, interfaces)
+	registry := prometheus.NewRegistry()
+	failed := make(chan error, 3)
+	if !assert.NoError(t, startCollectors(ctx, config, interfaces, registry, failed)) {
+		return
+	}
+
+	expected := []string{
+		`iftop_flow_bytes_total{direction="src_to_dst",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234"} 2816`,
+		`iftop_flow_bytes_total{direction="dst_to_src",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234"} 31744`,
+		`iftop_flow_bytes_total{direction="src_to_dst",dst_host="192.168.1.5",dst_port="60001",family="ipv4",iface="igb0",src_host="192.168.1.22",src_port="22"} 745`,
+		`iftop_flow_bytes_total{direction="src_to_dst",dst_host="2606:4700:4700::1111",dst_port="443",family="ipv6",iface="igb0",src_host="2001:db8::10",src_port="51234"} 1024`,
+		`iftop_flow_bytes_total{direction="src_to_dst",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb1",src_host="192.168.1.10",src_port="51234"} 2816`,
+		`iftop_flow_rate_bytes_per_second{direction="dst_to_src",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234",window="2s"} 15564.8`,
+		`iftop_flow_rate_bytes_per_second{direction="src_to_dst",dst_host="192.168.1.5",dst_port="60001",family="ipv4",iface="igb0",src_host="192.168.1.22",src_port="22",window="40s"} 298`,
+		`iftop_interface_rate_bytes_per_second{direction="receive",iface="igb0",window="10s"} 12902.4`,
+		`iftop_interface_bytes_total{direction="total",iface="igb0"} 35840`,
+		`iftop_readings_total{iface="igb1"}`,
+		`flows_active{iface="igb0"} 3`,
+		`netstat_nic_bytes_total{direction="ingress",nic="igb0"} 1.773036112075e+12`,
+		`netstat_address_bytes_total{address="192.168.1.1",direction="egress",network="192.168.1.0/24",nic="igb0"} 131072`,
+	}
+	collected := assert.Eventually(t, func() bool {
+		exposition := scrape(t, registry)
+		for _, line := range expected {
+			if !strings.Contains(exposition, line) {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 20*time.Millisecond)
+	if !collected {
+		t.Logf("exposition:\n%s", scrape(t, registry))
+	}
+	select {
+	case err := <-failed:
+		t.Fatal(err)
+	default:
+	}
+	assert.Contains(t, server.Executed(), "iftop -nNbB -i igb0 -t -L 100 -P")
+	assert.Contains(t, server.Executed(), "iftop -nNbB -i igb1 -t -L 100 -P")
+	assert.Equal(t, 1, server.Connections(), "interfaces share a connection")
+}
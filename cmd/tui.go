@@ -2,22 +2,45 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/engine"
 	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/iftop"
+	"sync"
 )
 
-func tuiMain(config *options) error {
-	return engine.Run(context.Background(), &engine.Config{
-		PfsenseUser:      config.pfsenseUser,
-		PfsenseAddress:   config.pfsenseAddress,
-		PfsensePassword:  config.pfsensePassword,
-		NetworkInterface: config.networkInterface,
-	}, func(ctx context.Context, reading *iftop.Reading, interpreter *iftop.IftopInterpreter) error {
-		for _, f := range reading.Frames {
-			fmt.Printf("\t%s\t%s\t<=>\t%s\t%s\n", f.Source.Address, f.Source.Cumulative, f.Destination.Address, f.Destination.Cumulative)
-		}
-		fmt.Printf("\n")
-		return nil
-	})
+func tuiMain(ctx context.Context, config *options) error {
+	interfaces, err := config.interfaces(ctx)
+	if err != nil {
+		return err
+	}
+	// frames from different interfaces are printed whole rather than interleaved
+	var output sync.Mutex
+	problems := make([]error, len(interfaces))
+	var running sync.WaitGroup
+	for index, iface := range interfaces {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			engineConfig := config.engineConfig()
+			engineConfig.NetworkInterface = iface
+			err := engine.Supervise(ctx, &engineConfig, config.restartPolicy, func(ctx context.Context, reading *iftop.Reading, interpreter *iftop.IftopInterpreter) error {
+				output.Lock()
+				defer output.Unlock()
+				if len(interfaces) > 1 {
+					fmt.Printf("%s\n", iface)
+				}
+				for _, f := range reading.Frames {
+					fmt.Printf("\t%s\t%s\t<=>\t%s\t%s\n", f.Source.Address, f.Source.Cumulative, f.Destination.Address, f.Destination.Cumulative)
+				}
+				fmt.Printf("\n")
+				return nil
+			})
+			if ctx.Err() == nil && !errors.Is(err, engine.ErrReplayExhausted) {
+				problems[index] = fmt.Errorf("iftop(%s): %w", iface, err)
+			}
+		}()
+	}
+	running.Wait()
+	return errors.Join(problems...)
 }
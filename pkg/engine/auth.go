@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/melbahja/goph"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+	"strings"
+)
+
+// authMethods builds the SSH authentication methods from the configuration.  When several are configured they are
+// offered in the following order:
+//  1. keys held by the agent listening on AgentSocket
+//  2. the key stored in PrivateKeyFile
+//  3. PfsensePassword
+//
+// Agent and file keys are offered through a single public key method since the SSH client will not retry a method it
+// has already attempted.  The returned release function closes the agent connection and should be called once the
+// handshake is complete.
+func (c *Config) authMethods() (auth goph.Auth, release func(), problem error) {
+	release = func() {}
+	var signers []ssh.Signer
+
+	if c.AgentSocket != "" {
+		conn, err := net.Dial("unix", c.AgentSocket)
+		if err != nil {
+			return nil, release, fmt.Errorf("ssh agent %q: %w", c.AgentSocket, err)
+		}
+		release = func() { _ = conn.Close() }
+		agentSigners, err := agent.NewClient(conn).Signers()
+		if err != nil {
+			release()
+			return nil, func() {}, fmt.Errorf("ssh agent %q: %w", c.AgentSocket, err)
+		}
+		signers = append(signers, agentSigners...)
+	}
+
+	if c.PrivateKeyFile != "" {
+		passphrase := c.PrivateKeyPassphrase
+		if passphrase == "" && c.PrivateKeyPassphraseFile != "" {
+			var err error
+			if passphrase, err = readSecret(c.PrivateKeyPassphraseFile); err != nil {
+				release()
+				return nil, func() {}, fmt.Errorf("private key passphrase file: %w", err)
+			}
+		}
+		signer, err := goph.GetSigner(c.PrivateKeyFile, passphrase)
+		if err != nil {
+			release()
+			return nil, func() {}, fmt.Errorf("private key %q: %w", c.PrivateKeyFile, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if c.PfsensePassword != "" {
+		auth = append(auth, ssh.Password(c.PfsensePassword))
+	}
+	if len(auth) == 0 {
+		release()
+		return nil, func() {}, fmt.Errorf("no ssh authentication configured: provide a password, private key, or agent socket")
+	}
+	return auth, release, nil
+}
+
+// readSecret reads a password or passphrase from file, ignoring the trailing line break editors and echo leave.
+func readSecret(file string) (string, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
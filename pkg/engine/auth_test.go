@@ -0,0 +1,124 @@
+package engine_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/engine"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/pfsensetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newKey generates a key authorized by server.
+func newKey(t *testing.T, server *pfsensetest.Server) ed25519.PrivateKey {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(private)
+	require.NoError(t, err)
+	server.AuthorizeKey(signer.PublicKey())
+	return private
+}
+
+func fingerprint(t *testing.T, private ed25519.PrivateKey) string {
+	signer, err := ssh.NewSignerFromKey(private)
+	require.NoError(t, err)
+	return ssh.FingerprintSHA256(signer.PublicKey())
+}
+
+// writeKey writes private to a file encrypted with passphrase, along with a file holding the passphrase.
+func writeKey(t *testing.T, private ed25519.PrivateKey, passphrase string) (keyFile string, passphraseFile string) {
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(private, "", []byte(passphrase))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	keyFile = filepath.Join(dir, "id_ed25519")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600))
+	passphraseFile = filepath.Join(dir, "passphrase")
+	require.NoError(t, os.WriteFile(passphraseFile, []byte(passphrase+"\n"), 0600))
+	return keyFile, passphraseFile
+}
+
+// serveAgent runs an ssh-agent holding private, returning its socket.
+func serveAgent(t *testing.T, private ed25519.PrivateKey) string {
+	keyring := agent.NewKeyring()
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: private}))
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return socket
+}
+
+// connect runs a command on a fresh connection described by config.
+func connect(t *testing.T, config engine.Config) {
+	stream := &engine.SSHStream{Config: &config, Pool: engine.NewPool()}
+	t.Cleanup(func() { _ = stream.Pool.Close() })
+	lines, err := stream.StreamCommand(context.Background(), 8, "netstat")
+	require.NoError(t, err)
+	for line := range lines {
+		require.NoError(t, line.Problem)
+	}
+}
+
+func TestAuthenticatesWithEncryptedPrivateKey(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	server.Handle("netstat", pfsensetest.Command{})
+	key := newKey(t, server)
+	config := server.Config()
+	config.PfsensePassword = ""
+	config.PrivateKeyFile, config.PrivateKeyPassphraseFile = writeKey(t, key, "correct horse")
+
+	connect(t, config)
+	assert.Equal(t, []string{fingerprint(t, key)}, server.Authenticated())
+}
+
+func TestAuthenticatesWithAgent(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	server.Handle("netstat", pfsensetest.Command{})
+	key := newKey(t, server)
+	config := server.Config()
+	config.PfsensePassword = ""
+	config.AgentSocket = serveAgent(t, key)
+
+	connect(t, config)
+	assert.Equal(t, []string{fingerprint(t, key)}, server.Authenticated())
+}
+
+func TestAuthenticationPrefersAgentThenPrivateKeyThenPassword(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	server.Handle("netstat", pfsensetest.Command{})
+	agentKey := newKey(t, server)
+	fileKey := newKey(t, server)
+	config := server.Config()
+	config.AgentSocket = serveAgent(t, agentKey)
+	config.PrivateKeyFile, config.PrivateKeyPassphraseFile = writeKey(t, fileKey, "correct horse")
+
+	connect(t, config)
+	config.AgentSocket = ""
+	connect(t, config)
+	config.PrivateKeyFile = ""
+	connect(t, config)
+	// keys the server does not accept fall through to the next method
+	config.AgentSocket = serveAgent(t, newKey(t, pfsensetest.NewServer(t)))
+	connect(t, config)
+	assert.Equal(t, []string{fingerprint(t, agentKey), fingerprint(t, fileKey), "password", "password"}, server.Authenticated())
+}
@@ -2,38 +2,139 @@ package engine
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/iftop"
-	"os"
+	"log/slog"
+	"time"
 )
 
+// ErrStalled is returned when a stream stops producing output while remaining open.
+var ErrStalled = errors.New("stream stalled")
+
 type Config struct {
-	PfsenseUser      string
-	PfsenseAddress   string
-	PfsensePassword  string
+	// Transport selects how commands are run: TransportSSH, TransportLocal, or TransportReplay.
+	Transport string
+	// RecordDir receives a capture of every command's output when set.
+	RecordDir string
+	// ReplayDir holds the captures replayed by TransportReplay.
+	ReplayDir string
+	// ReplaySpeed scales the pace of replayed captures; 0 replays as quickly as possible.
+	ReplaySpeed    float64
+	PfsenseUser    string
+	PfsenseAddress string
+	// PfsensePort is the SSH port of pfSense, 22 when zero.
+	PfsensePort     int
+	PfsensePassword string
+	// PrivateKeyFile is the path to a private key used for public key authentication.
+	PrivateKeyFile string
+	// PrivateKeyPassphrase decrypts PrivateKeyFile when the key is encrypted.
+	PrivateKeyPassphrase string
+	// PrivateKeyPassphraseFile holds the passphrase of PrivateKeyFile, read when dialing, keeping it off the command
+	// line.  Used when PrivateKeyPassphrase is empty.
+	PrivateKeyPassphraseFile string
+	// AgentSocket is the path to the unix socket of an ssh-agent, typically the value of SSH_AUTH_SOCK.
+	AgentSocket string
+	// KnownHostsFile is an OpenSSH known_hosts file used to verify the pfSense host key.
+	KnownHostsFile string
+	// TrustOnFirstUse records the host key in KnownHostsFile when the host is not yet listed.
+	TrustOnFirstUse bool
+	// HostKeyFingerprint pins the SHA256 fingerprint of the pfSense host key, as printed by ssh-keygen -l.
+	HostKeyFingerprint string
+	// InsecureIgnoreHostKey disables host key verification entirely.
+	InsecureIgnoreHostKey bool
+	// JumpHosts are tunneled through in order to reach pfSense.
+	JumpHosts []JumpHost
+	// KeepAliveInterval is how often an idle SSH connection is probed; zero disables keepalives.
+	KeepAliveInterval time.Duration
+	// FrameTimeout is how long Run waits for a complete iftop frame before treating the stream as stalled; zero waits
+	// forever.
+	FrameTimeout time.Duration
+	// IftopUnitBase is the scaling iftop applies between unit prefixes, iftop.BinaryUnits when zero.
+	IftopUnitBase    iftop.UnitBase
 	NetworkInterface string
+	// Iftop tunes how iftop is invoked.
+	Iftop IftopOptions
+}
+
+// collectorLogger attributes log records to a collector and, for per interface collectors, the interface.
+func collectorLogger(collector string, iface string) *slog.Logger {
+	logger := slog.Default().With("collector", collector)
+	if iface != "" {
+		logger = logger.With("iface", iface)
+	}
+	return logger
+}
+
+func (c *Config) sshPort() int {
+	if c.PfsensePort == 0 {
+		return 22
+	}
+	return c.PfsensePort
 }
 
 func Run(ctx context.Context, config *Config, onFrameDone iftop.OnFrameDone) (problem error) {
-	streamer := SSHStream{Config: config}
-	lines, err := streamer.StreamCommand(256, "iftop", "-nNbB", "-i", config.NetworkInterface, "-t", "-L", "100", "-P")
+	// stops the remote iftop when returning early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	args, err := config.Iftop.args(config.NetworkInterface)
+	if err != nil {
+		return err
+	}
+	streamer, err := NewTransport(config)
+	if err != nil {
+		return err
+	}
+	lines, err := streamer.StreamCommand(ctx, 256, "iftop", args...)
 	if err != nil {
 		return err
 	}
 
-	i := iftop.NewInterpreter(onFrameDone)
-	for l := range lines {
-		if l.Problem != nil {
-			return l.Problem
-		}
-		if l.Stdout != nil {
-			if err := i.Interpret(*l.Stdout); err != nil {
-				return err
+	// the watchdog fires when iftop stops producing frames without the stream closing
+	var watchdog <-chan time.Time
+	if config.FrameTimeout > 0 {
+		timer := time.NewTimer(config.FrameTimeout)
+		defer timer.Stop()
+		watchdog = timer.C
+		onFrameDone = resetOnFrame(timer, config.FrameTimeout, onFrameDone)
+	}
+
+	logger := collectorLogger("iftop", config.NetworkInterface)
+	i := iftop.NewInterpreter(func(ctx context.Context, reading *iftop.Reading, interpreter *iftop.IftopInterpreter) error {
+		RecordReading("iftop", config.NetworkInterface)
+		return onFrameDone(ctx, reading, interpreter)
+	})
+	i.Logger = logger
+	if config.IftopUnitBase != 0 {
+		i.UnitBase = config.IftopUnitBase
+	}
+	for {
+		select {
+		case <-watchdog:
+			return fmt.Errorf("no iftop frame on %s within %s: %w", config.NetworkInterface, config.FrameTimeout, ErrStalled)
+		case l, ok := <-lines:
+			if !ok {
+				return ctx.Err()
+			}
+			if l.Problem != nil {
+				return l.Problem
+			}
+			if l.Stdout != nil {
+				if err := i.InterpretAt(*l.Stdout, l.At); err != nil {
+					return err
+				}
+			}
+			if l.Stderr != nil {
+				logger.Warn("remote stderr", "line", *l.Stderr)
 			}
 		}
-		if l.Stderr != nil {
-			fmt.Fprintf(os.Stderr, "iftop.stderr(remote): %s\n", *l.Stderr)
-		}
 	}
-	return nil
+}
+
+func resetOnFrame(timer *time.Timer, timeout time.Duration, onFrameDone iftop.OnFrameDone) iftop.OnFrameDone {
+	return func(ctx context.Context, reading *iftop.Reading, interpreter *iftop.IftopInterpreter) error {
+		timer.Reset(timeout)
+		return onFrameDone(ctx, reading, interpreter)
+	}
 }
@@ -0,0 +1,77 @@
+package engine_test
+
+import (
+	"context"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/engine"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/iftop"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/pfsensetest"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunDetectsStalledStream(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	server.Handle("iftop", pfsensetest.Command{Stdout: []string{"Listening on igb0"}, Hold: true})
+	config := server.Config()
+	config.NetworkInterface = "igb0"
+	config.FrameTimeout = 100 * time.Millisecond
+
+	err := engine.Run(context.Background(), &config, func(ctx context.Context, reading *iftop.Reading, interpreter *iftop.IftopInterpreter) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, engine.ErrStalled)
+	assert.Eventually(t, func() bool {
+		return len(server.Signals()) == 1
+	}, 5*time.Second, 10*time.Millisecond, "stalled iftop is terminated")
+}
+
+func TestRunPassesIftopOptions(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	config := server.Config()
+	config.NetworkInterface = "igb0"
+	config.Iftop = engine.IftopOptions{Filter: "not port 873", LineLimit: 20, SortBy: engine.IftopSort40s}
+
+	_ = engine.Run(context.Background(), &config, func(ctx context.Context, reading *iftop.Reading, interpreter *iftop.IftopInterpreter) error {
+		return nil
+	})
+	assert.Equal(t, []string{"iftop -nNbB -i igb0 -t -L 20 -P -f 'not port 873' -o 40s"}, server.Executed())
+}
+
+func TestSuperviseRejectsInvalidIftopOptions(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	config := server.Config()
+	config.NetworkInterface = "igb0"
+	config.Iftop = engine.IftopOptions{SortBy: "rate"}
+
+	err := engine.Supervise(context.Background(), &config, engine.DefaultRestartPolicy(), func(ctx context.Context, reading *iftop.Reading, interpreter *iftop.IftopInterpreter) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, engine.ErrInvalidIftopOption)
+	assert.Empty(t, server.Executed())
+}
+
+func TestSuperviseRejectsUnusableConfig(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	noPolicy := server.Config()
+	noPolicy.HostKeyFingerprint = ""
+	noCredentials := server.Config()
+	noCredentials.PfsensePassword = ""
+	missingKey := server.Config()
+	missingKey.PrivateKeyFile = filepath.Join(t.TempDir(), "id_ed25519")
+	badJump := server.Config()
+	badJump.JumpHosts = []engine.JumpHost{{User: "root", Address: "bastion", Port: 22, PasswordFile: filepath.Join(t.TempDir(), "missing")}}
+
+	for name, config := range map[string]engine.Config{"host key policy": noPolicy, "credentials": noCredentials, "private key": missingKey, "jump host": badJump} {
+		config.NetworkInterface = "igb0"
+		// the default policy retries forever, so a retried failure would never return
+		err := engine.Supervise(context.Background(), &config, engine.DefaultRestartPolicy(), func(ctx context.Context, reading *iftop.Reading, interpreter *iftop.IftopInterpreter) error {
+			return nil
+		})
+		assert.Error(t, err, name)
+	}
+	assert.ErrorIs(t, noPolicy.Check(), engine.ErrNoHostKeyPolicy)
+	assert.Empty(t, server.Executed())
+	assert.Zero(t, server.Connections())
+}
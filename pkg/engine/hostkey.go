@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrNoHostKeyPolicy is returned when no means of verifying the remote host key has been configured.
+var ErrNoHostKeyPolicy = errors.New("no host key verification configured: provide a known hosts file, a host key fingerprint, or explicitly disable verification")
+
+// ErrUnknownHostKey is returned when the remote host is not listed in the known hosts file and trust on first use is
+// disabled.
+var ErrUnknownHostKey = errors.New("host key is unknown")
+
+// HostKeyMismatchError is returned when the key presented by the remote host does not match the trusted key.
+type HostKeyMismatchError struct {
+	Host string
+	// Expected contains the SHA256 fingerprints of the trusted keys.
+	Expected []string
+	// Actual is the SHA256 fingerprint of the key presented by the host.
+	Actual string
+}
+
+func (h *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s: presented %s, expected %s", h.Host, h.Actual, strings.Join(h.Expected, " or "))
+}
+
+// knownHostsWriter serializes trust on first use writes as several connections may be established at once.
+var knownHostsWriter sync.Mutex
+
+// hostKeyCallback builds the host key verification policy.  A pinned fingerprint takes precedence over the known hosts
+// file.  Skipping verification must be requested explicitly.
+func (c *Config) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	switch {
+	case c.HostKeyFingerprint != "":
+		return fingerprintCallback(c.HostKeyFingerprint), nil
+	case c.KnownHostsFile != "":
+		return knownHostsCallback(c.KnownHostsFile, c.TrustOnFirstUse), nil
+	case c.InsecureIgnoreHostKey:
+		return ssh.InsecureIgnoreHostKey(), nil
+	default:
+		return nil, ErrNoHostKeyPolicy
+	}
+}
+
+func fingerprintCallback(fingerprint string) ssh.HostKeyCallback {
+	expected := fingerprint
+	if !strings.HasPrefix(expected, "SHA256:") {
+		expected = "SHA256:" + expected
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		actual := ssh.FingerprintSHA256(key)
+		if actual != expected {
+			return &HostKeyMismatchError{Host: hostname, Expected: []string{expected}, Actual: actual}
+		}
+		return nil
+	}
+}
+
+func knownHostsCallback(file string, trustOnFirstUse bool) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsWriter.Lock()
+		defer knownHostsWriter.Unlock()
+
+		if trustOnFirstUse {
+			// knownhosts refuses to load a file which does not exist yet
+			handle, err := os.OpenFile(file, os.O_CREATE|os.O_RDONLY, 0600)
+			if err != nil {
+				return err
+			}
+			if err := handle.Close(); err != nil {
+				return err
+			}
+		}
+
+		check, err := knownhosts.New(file)
+		if err != nil {
+			return err
+		}
+		err = check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if err == nil || !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			expected := make([]string, len(keyErr.Want))
+			for i, want := range keyErr.Want {
+				expected[i] = ssh.FingerprintSHA256(want.Key)
+			}
+			return &HostKeyMismatchError{Host: hostname, Expected: expected, Actual: ssh.FingerprintSHA256(key)}
+		}
+		if !trustOnFirstUse {
+			return fmt.Errorf("%s (%s) in %s: %w", hostname, ssh.FingerprintSHA256(key), file, ErrUnknownHostKey)
+		}
+		slog.Info("trusting host key on first use", "host", hostname, "fingerprint", ssh.FingerprintSHA256(key), "known_hosts", file)
+		return appendKnownHost(file, hostname, key)
+	}
+}
+
+func appendKnownHost(file string, hostname string, key ssh.PublicKey) (problem error) {
+	handle, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		problem = errors.Join(problem, handle.Close())
+	}()
+	_, err = fmt.Fprintln(handle, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return err
+}
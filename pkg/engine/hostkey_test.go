@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func generateHostKey(t *testing.T) ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := ssh.NewPublicKey(public)
+	require.NoError(t, err)
+	return key
+}
+
+var testRemote = &net.TCPAddr{IP: net.IPv4(192, 168, 100, 1), Port: 22}
+
+func TestHostKeyRequiresPolicy(t *testing.T) {
+	_, err := (&Config{}).hostKeyCallback()
+	assert.ErrorIs(t, err, ErrNoHostKeyPolicy)
+}
+
+func TestHostKeyFingerprint(t *testing.T) {
+	trusted := generateHostKey(t)
+	callback, err := (&Config{HostKeyFingerprint: ssh.FingerprintSHA256(trusted)}).hostKeyCallback()
+	require.NoError(t, err)
+	assert.NoError(t, callback("192.168.100.1:22", testRemote, trusted))
+
+	var mismatch *HostKeyMismatchError
+	err = callback("192.168.100.1:22", testRemote, generateHostKey(t))
+	if assert.ErrorAs(t, err, &mismatch) {
+		assert.Equal(t, []string{ssh.FingerprintSHA256(trusted)}, mismatch.Expected)
+	}
+}
+
+func TestHostKeyTrustOnFirstUse(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	trusted := generateHostKey(t)
+
+	strict, err := (&Config{KnownHostsFile: file}).hostKeyCallback()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(file, nil, 0600))
+	assert.ErrorIs(t, strict("192.168.100.1:22", testRemote, trusted), ErrUnknownHostKey)
+
+	tofu, err := (&Config{KnownHostsFile: file, TrustOnFirstUse: true}).hostKeyCallback()
+	require.NoError(t, err)
+	require.NoError(t, tofu("192.168.100.1:22", testRemote, trusted))
+	assert.NoError(t, strict("192.168.100.1:22", testRemote, trusted), "recorded key is trusted afterwards")
+
+	var mismatch *HostKeyMismatchError
+	assert.ErrorAs(t, tofu("192.168.100.1:22", testRemote, generateHostKey(t)), &mismatch, "recorded key is not replaced")
+}
@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidIftopOption is returned when an iftop option can not be safely passed to iftop.
+var ErrInvalidIftopOption = errors.New("invalid iftop option")
+
+// Columns iftop may sort flows by.
+const (
+	IftopSort2s          = "2s"
+	IftopSort10s         = "10s"
+	IftopSort40s         = "40s"
+	IftopSortSource      = "source"
+	IftopSortDestination = "destination"
+)
+
+// DefaultIftopLineLimit is the number of flows iftop prints per frame unless configured otherwise.
+const DefaultIftopLineLimit = 100
+
+// IftopOptions tune how iftop is invoked.
+type IftopOptions struct {
+	// Filter is a pcap filter expression, as accepted by tcpdump, selecting the packets iftop counts.
+	Filter string
+	// NetFilter restricts iftop to traffic entering or leaving an IPv4 network, given as address/prefix length.
+	NetFilter string
+	// NetFilter6 restricts iftop to traffic entering or leaving an IPv6 network, given as address/prefix length.
+	NetFilter6 string
+	// LineLimit caps the flows printed in each frame, DefaultIftopLineLimit when zero.
+	LineLimit int
+	// SortBy is the column flows are sorted by: one of the IftopSort constants, or iftop's default when empty.
+	SortBy string
+	// Promiscuous counts traffic passing through the interface which is not addressed to the firewall.
+	Promiscuous bool
+}
+
+// args builds the iftop command line for iface, rejecting values which iftop would not accept.
+func (o IftopOptions) args(iface string) ([]string, error) {
+	if iface == "" || strings.IndexFunc(iface, func(r rune) bool {
+		return !(r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' || r == '-'))
+	}) >= 0 {
+		return nil, fmt.Errorf("%w: interface %q", ErrInvalidIftopOption, iface)
+	}
+	lineLimit := o.LineLimit
+	if lineLimit == 0 {
+		lineLimit = DefaultIftopLineLimit
+	}
+	if lineLimit < 0 {
+		return nil, fmt.Errorf("%w: line limit %d is negative", ErrInvalidIftopOption, lineLimit)
+	}
+	args := []string{"-nNbB", "-i", iface, "-t", "-L", strconv.Itoa(lineLimit), "-P"}
+
+	if o.Filter != "" {
+		if strings.IndexFunc(o.Filter, unicode.IsControl) >= 0 {
+			return nil, fmt.Errorf("%w: filter %q contains control characters", ErrInvalidIftopOption, o.Filter)
+		}
+		args = append(args, "-f", o.Filter)
+	}
+	if o.NetFilter != "" {
+		network, err := netip.ParsePrefix(o.NetFilter)
+		if err != nil || !network.Addr().Is4() {
+			return nil, fmt.Errorf("%w: net filter %q is not an IPv4 network", ErrInvalidIftopOption, o.NetFilter)
+		}
+		args = append(args, "-F", network.String())
+	}
+	if o.NetFilter6 != "" {
+		network, err := netip.ParsePrefix(o.NetFilter6)
+		if err != nil || !network.Addr().Is6() {
+			return nil, fmt.Errorf("%w: net filter %q is not an IPv6 network", ErrInvalidIftopOption, o.NetFilter6)
+		}
+		args = append(args, "-G", network.String())
+	}
+	switch o.SortBy {
+	case "":
+	case IftopSort2s, IftopSort10s, IftopSort40s, IftopSortSource, IftopSortDestination:
+		args = append(args, "-o", o.SortBy)
+	default:
+		return nil, fmt.Errorf("%w: unknown sort column %q", ErrInvalidIftopOption, o.SortBy)
+	}
+	if o.Promiscuous {
+		args = append(args, "-p")
+	}
+	return args, nil
+}
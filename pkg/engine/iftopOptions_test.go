@@ -0,0 +1,45 @@
+package engine
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestIftopOptionsArgs(t *testing.T) {
+	args, err := IftopOptions{}.args("igb0")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-nNbB", "-i", "igb0", "-t", "-L", "100", "-P"}, args)
+
+	args, err = IftopOptions{
+		Filter:      "not port 873",
+		NetFilter:   "192.168.1.0/24",
+		NetFilter6:  "2001:db8::/64",
+		LineLimit:   500,
+		SortBy:      IftopSortSource,
+		Promiscuous: true,
+	}.args("igb0.10")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-nNbB", "-i", "igb0.10", "-t", "-L", "500", "-P", "-f", "not port 873", "-F", "192.168.1.0/24", "-G", "2001:db8::/64", "-o", "source", "-p"}, args)
+}
+
+func TestIftopOptionsRejectsInvalid(t *testing.T) {
+	for name, example := range map[string]struct {
+		options IftopOptions
+		iface   string
+	}{
+		"empty interface":     {iface: ""},
+		"interface injection": {iface: "igb0;reboot"},
+		"negative limit":      {options: IftopOptions{LineLimit: -1}, iface: "igb0"},
+		"filter newline":      {options: IftopOptions{Filter: "port 22\nreboot"}, iface: "igb0"},
+		"net filter not cidr": {options: IftopOptions{NetFilter: "192.168.1.0"}, iface: "igb0"},
+		"net filter ipv6":     {options: IftopOptions{NetFilter: "2001:db8::/64"}, iface: "igb0"},
+		"net filter6 ipv4":    {options: IftopOptions{NetFilter6: "10.0.0.0/8"}, iface: "igb0"},
+		"unknown sort":        {options: IftopOptions{SortBy: "rate"}, iface: "igb0"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := example.options.args(example.iface)
+			assert.ErrorIs(t, err, ErrInvalidIftopOption)
+		})
+	}
+}
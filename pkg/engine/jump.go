@@ -0,0 +1,109 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// JumpHost is an SSH server the connection to pfSense is tunneled through, as with OpenSSH's ProxyJump.  Each hop
+// authenticates on its own; host keys are verified against the known hosts policy of the Config unless a fingerprint
+// is pinned for the hop.
+type JumpHost struct {
+	User    string
+	Address string
+	// Port is the SSH port of the hop, 22 when zero.
+	Port     int
+	Password string
+	// PasswordFile holds the password of the hop, read when dialing, keeping it off the command line.  Used when
+	// Password is empty.
+	PasswordFile         string
+	PrivateKeyFile       string
+	PrivateKeyPassphrase string
+	// PrivateKeyPassphraseFile holds the passphrase of PrivateKeyFile, keeping it off the command line.  Used when
+	// PrivateKeyPassphrase is empty.
+	PrivateKeyPassphraseFile string
+	AgentSocket              string
+	HostKeyFingerprint       string
+}
+
+// config describes the hop in terms of a Config so it is dialed like the final destination.
+func (j JumpHost) config(target *Config) (*Config, error) {
+	password := j.Password
+	if password == "" && j.PasswordFile != "" {
+		var err error
+		if password, err = readSecret(j.PasswordFile); err != nil {
+			return nil, fmt.Errorf("password file: %w", err)
+		}
+	}
+	return &Config{
+		PfsenseUser:              j.User,
+		PfsenseAddress:           j.Address,
+		PfsensePort:              j.Port,
+		PfsensePassword:          password,
+		PrivateKeyFile:           j.PrivateKeyFile,
+		PrivateKeyPassphrase:     j.PrivateKeyPassphrase,
+		PrivateKeyPassphraseFile: j.PrivateKeyPassphraseFile,
+		AgentSocket:              j.AgentSocket,
+		KnownHostsFile:           target.KnownHostsFile,
+		TrustOnFirstUse:          target.TrustOnFirstUse,
+		HostKeyFingerprint:       j.HostKeyFingerprint,
+		InsecureIgnoreHostKey:    target.InsecureIgnoreHostKey,
+	}, nil
+}
+
+func (j JumpHost) String() string {
+	return j.User + "@" + net.JoinHostPort(j.Address, strconv.Itoa(j.Port))
+}
+
+// ParseJumpHost parses a hop written as [user@]host[:port] followed by comma separated options: identity=FILE,
+// passphrase-file=FILE, password-file=FILE, agent=SOCKET, and fingerprint=SHA256:.... Secrets are read from files to
+// keep them off the command line.  IPv6 addresses with a port must be bracketed.  defaultUser is used when the user is omitted.
+func ParseJumpHost(spec string, defaultUser string) (JumpHost, error) {
+	parts := strings.Split(spec, ",")
+	hop := JumpHost{User: defaultUser, Port: 22}
+
+	destination := parts[0]
+	if at := strings.LastIndex(destination, "@"); at >= 0 {
+		hop.User = destination[:at]
+		destination = destination[at+1:]
+	}
+	if strings.HasPrefix(destination, "[") || strings.Count(destination, ":") == 1 {
+		host, port, err := net.SplitHostPort(destination)
+		if err != nil {
+			return JumpHost{}, fmt.Errorf("jump host %q: %w", spec, err)
+		}
+		hop.Port, err = strconv.Atoi(port)
+		if err != nil || hop.Port <= 0 || hop.Port > 65535 {
+			return JumpHost{}, fmt.Errorf("jump host %q: invalid port %q", spec, port)
+		}
+		destination = host
+	}
+	if destination == "" || hop.User == "" {
+		return JumpHost{}, fmt.Errorf("jump host %q: expected [user@]host[:port]", spec)
+	}
+	hop.Address = destination
+
+	for _, option := range parts[1:] {
+		name, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return JumpHost{}, fmt.Errorf("jump host %q: option %q is not name=value", spec, option)
+		}
+		switch name {
+		case "identity":
+			hop.PrivateKeyFile = value
+		case "passphrase-file":
+			hop.PrivateKeyPassphraseFile = value
+		case "password-file":
+			hop.PasswordFile = value
+		case "agent":
+			hop.AgentSocket = value
+		case "fingerprint":
+			hop.HostKeyFingerprint = value
+		default:
+			return JumpHost{}, fmt.Errorf("jump host %q: unknown option %q", spec, name)
+		}
+	}
+	return hop, nil
+}
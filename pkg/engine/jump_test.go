@@ -0,0 +1,47 @@
+package engine
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseJumpHost(t *testing.T) {
+	hop, err := ParseJumpHost("bastion.example.com", "root")
+	require.NoError(t, err)
+	assert.Equal(t, JumpHost{User: "root", Address: "bastion.example.com", Port: 22}, hop)
+
+	hop, err = ParseJumpHost("ops@10.0.0.2:2222,identity=/keys/bastion,passphrase-file=/secrets/bastion-key,fingerprint=SHA256:abc", "root")
+	require.NoError(t, err)
+	assert.Equal(t, JumpHost{
+		User:                     "ops",
+		Address:                  "10.0.0.2",
+		Port:                     2222,
+		PrivateKeyFile:           "/keys/bastion",
+		PrivateKeyPassphraseFile: "/secrets/bastion-key",
+		HostKeyFingerprint:       "SHA256:abc",
+	}, hop)
+	hopConfig, err := hop.config(&Config{})
+	require.NoError(t, err)
+	assert.Equal(t, "/secrets/bastion-key", hopConfig.PrivateKeyPassphraseFile)
+
+	hop, err = ParseJumpHost("ops@[2001:db8::2]:2222,agent=/run/agent.sock,password-file=/secrets/bastion", "root")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::2", hop.Address)
+	assert.Equal(t, 2222, hop.Port)
+	assert.Equal(t, "/run/agent.sock", hop.AgentSocket)
+	assert.Equal(t, "/secrets/bastion", hop.PasswordFile)
+	assert.Empty(t, hop.Password)
+
+	hop, err = ParseJumpHost("2001:db8::2", "root")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::2", hop.Address)
+	assert.Equal(t, 22, hop.Port)
+}
+
+func TestParseJumpHostRejectsMalformed(t *testing.T) {
+	for _, spec := range []string{"", "ops@", "host:port", "host:70000", "host,identity", "host,color=blue", "host,password=secret", "host,passphrase=secret"} {
+		_, err := ParseJumpHost(spec, "root")
+		assert.Error(t, err, spec)
+	}
+}
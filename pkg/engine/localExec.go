@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LocalExec runs commands on the local machine.
+type LocalExec struct {
+}
+
+func (l *LocalExec) StreamCommand(ctx context.Context, bufferSize int, program string, args ...string) (output <-chan StreamLine, problem error) {
+	lines := make(chan StreamLine, bufferSize)
+	send := func(line StreamLine) bool {
+		select {
+		case lines <- line:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, program, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 5 * time.Second
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		// children of the command may hold the pipes open after it has been terminated
+		select {
+		case <-ctx.Done():
+			_ = stdout.Close()
+			_ = stderr.Close()
+		case <-finished:
+		}
+	}()
+
+	go func() {
+		defer close(lines)
+		defer close(finished)
+		var stderrDone sync.WaitGroup
+		stderrDone.Add(1)
+		go func() {
+			defer stderrDone.Done()
+			scanner := bufio.NewScanner(stderr)
+			for scanner.Scan() {
+				line := scanner.Text()
+				if !send(StreamLine{Stderr: &line, At: time.Now()}) {
+					return
+				}
+			}
+		}()
+
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !send(StreamLine{Stdout: &line, At: time.Now()}) {
+				break
+			}
+		}
+		problem := scanner.Err()
+		// pipes must be fully read before waiting unless the command is being abandoned
+		if ctx.Err() == nil && problem == nil {
+			stderrDone.Wait()
+		}
+		if err := cmd.Wait(); err != nil && problem == nil {
+			problem = err
+		}
+		stderrDone.Wait()
+		if err := ctx.Err(); err != nil {
+			problem = err
+		}
+		if problem != nil {
+			send(StreamLine{Problem: problem})
+		}
+	}()
+	return lines, nil
+}
@@ -0,0 +1,49 @@
+package engine
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestLocalExecStreamsOutput(t *testing.T) {
+	lines, err := (&LocalExec{}).StreamCommand(context.Background(), 1, "sh", "-c", "echo first; echo problem >&2; echo second")
+	require.NoError(t, err)
+
+	var stdout, stderr []string
+	for line := range lines {
+		require.NoError(t, line.Problem)
+		if line.Stdout != nil {
+			stdout = append(stdout, *line.Stdout)
+		}
+		if line.Stderr != nil {
+			stderr = append(stderr, *line.Stderr)
+		}
+	}
+	assert.Equal(t, []string{"first", "second"}, stdout)
+	assert.Equal(t, []string{"problem"}, stderr)
+}
+
+func TestLocalExecCancelTerminatesCommand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	lines, err := (&LocalExec{}).StreamCommand(ctx, 1, "sh", "-c", "echo started; sleep 60")
+	require.NoError(t, err)
+
+	first := <-lines
+	require.NotNil(t, first.Stdout)
+	cancel()
+
+	closed := make(chan struct{})
+	go func() {
+		for range lines {
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("output was not closed after cancellation")
+	}
+}
@@ -0,0 +1,250 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/melbahja/goph"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/ssh"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HealthCheckTimeout bounds how long a pooled connection may take to answer a keepalive before it is considered dead.
+var HealthCheckTimeout = 5 * time.Second
+
+var connectionsDialed = promauto.NewCounter(prometheus.CounterOpts{
+	Subsystem: "ssh",
+	Name:      "connections_dialed_total",
+	Help:      "Number of SSH connections established to pfSense",
+})
+
+var keepAliveFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Subsystem: "ssh",
+	Name:      "keepalive_failures_total",
+	Help:      "Number of SSH connections closed after failing to answer a keepalive",
+})
+
+// Pool holds one authenticated SSH client per firewall.  Each command runs in a new session on the shared client,
+// avoiding a handshake and authentication per command.  Connections are health checked as they are handed out and
+// re-dialed once the underlying connection has died.
+type Pool struct {
+	lock    sync.Mutex
+	clients map[string]*ssh.Client
+}
+
+// DefaultPool is used by SSHStream when no pool has been configured, allowing all collectors in the process to share
+// connections.
+var DefaultPool = NewPool()
+
+func NewPool() *Pool {
+	return &Pool{
+		clients: map[string]*ssh.Client{},
+	}
+}
+
+func poolKey(config *Config) string {
+	return config.PfsenseUser + "@" + net.JoinHostPort(config.PfsenseAddress, strconv.Itoa(config.sshPort()))
+}
+
+// Session opens a new session against the firewall described by config.  A session which fails to open on an existing
+// connection results in the connection being re-dialed once, unless the server rejected the session, such as once
+// OpenSSH's MaxSessions are open, as the connection still carries the sessions of other commands.
+func (p *Pool) Session(config *Config) (*ssh.Session, error) {
+	client, err := p.client(config)
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	var rejected *ssh.OpenChannelError
+	if err == nil || errors.As(err, &rejected) {
+		return session, err
+	}
+
+	p.evict(config, client)
+	client, err = p.client(config)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewSession()
+}
+
+// client returns a healthy client for the firewall, dialing when none exists or the existing one stopped responding.
+func (p *Pool) client(config *Config) (*ssh.Client, error) {
+	key := poolKey(config)
+	p.lock.Lock()
+	client, ok := p.clients[key]
+	p.lock.Unlock()
+	if ok {
+		if healthy(client) {
+			return client, nil
+		}
+		p.evict(config, client)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// another caller may have dialed while the lock was released
+	if client, ok := p.clients[key]; ok {
+		return client, nil
+	}
+	client, err := dial(config)
+	if err != nil {
+		return nil, err
+	}
+	connectionsDialed.Inc()
+	p.clients[key] = client
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+		p.evict(config, client)
+	}()
+	if config.KeepAliveInterval > 0 {
+		go p.keepAlive(config, client, closed)
+	}
+	return client, nil
+}
+
+// keepAlive probes the connection every KeepAliveInterval, evicting it once a probe goes unanswered.  Closing the
+// connection fails any sessions blocked reading from a half dead network path.
+func (p *Pool) keepAlive(config *Config, client *ssh.Client, closed <-chan struct{}) {
+	ticker := time.NewTicker(config.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			if !healthy(client) {
+				keepAliveFailures.Inc()
+				slog.Warn("ssh keepalive unanswered, closing connection", "host", poolKey(config))
+				p.evict(config, client)
+				return
+			}
+		}
+	}
+}
+
+// evict removes client from the pool if it is still the current client for the firewall and closes it.
+func (p *Pool) evict(config *Config, client *ssh.Client) {
+	key := poolKey(config)
+	p.lock.Lock()
+	if p.clients[key] == client {
+		delete(p.clients, key)
+	}
+	p.lock.Unlock()
+	_ = client.Close()
+}
+
+// Close closes all pooled connections.
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var problem error
+	for key, client := range p.clients {
+		if err := client.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			problem = errors.Join(problem, err)
+		}
+		delete(p.clients, key)
+	}
+	return problem
+}
+
+// healthy sends a keepalive request over the connection, waiting at most HealthCheckTimeout for the response.
+func healthy(client *ssh.Client) bool {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err == nil
+	case <-time.After(HealthCheckTimeout):
+		return false
+	}
+}
+
+// dial connects to pfSense, tunneling through each of the configured jump hosts in turn.
+func dial(config *Config) (*ssh.Client, error) {
+	var hops []*ssh.Client
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			_ = hops[i].Close()
+		}
+	}
+
+	var client *ssh.Client
+	for _, jump := range config.JumpHosts {
+		var hop *ssh.Client
+		hopConfig, err := jump.config(config)
+		if err == nil {
+			hop, err = dialThrough(client, hopConfig)
+		}
+		if err != nil {
+			closeHops()
+			return nil, fmt.Errorf("jump host %s: %w", jump, err)
+		}
+		hops = append(hops, hop)
+		client = hop
+	}
+	target, err := dialThrough(client, config)
+	if err != nil {
+		closeHops()
+		return nil, err
+	}
+	if len(hops) > 0 {
+		go func() {
+			_ = target.Wait()
+			closeHops()
+		}()
+	}
+	return target, nil
+}
+
+// dialThrough connects to the host described by config, directly when via is nil or otherwise tunneled through via.
+func dialThrough(via *ssh.Client, config *Config) (*ssh.Client, error) {
+	hostKeyCallback, err := config.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	auth, releaseAuth, err := config.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseAuth()
+	clientConfig := &ssh.ClientConfig{
+		User:            config.PfsenseUser,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         goph.DefaultTimeout,
+	}
+	address := net.JoinHostPort(config.PfsenseAddress, strconv.Itoa(config.sshPort()))
+	if via == nil {
+		return ssh.Dial("tcp", address, clientConfig)
+	}
+
+	conn, err := via.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	// the timeout of the client config only applies when dialing directly and tunneled connections lack deadlines
+	abandon := time.AfterFunc(clientConfig.Timeout, func() {
+		_ = conn.Close()
+	})
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, address, clientConfig)
+	if !abandon.Stop() && err == nil {
+		_ = clientConn.Close()
+		err = fmt.Errorf("ssh handshake with %s timed out", address)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(clientConn, channels, requests), nil
+}
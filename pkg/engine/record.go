@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	captureStdout  = "stdout"
+	captureStderr  = "stderr"
+	captureProblem = "problem"
+)
+
+// captureRecord is a single line of a capture file.  Capture files hold one JSON encoded record per line.
+type captureRecord struct {
+	At     time.Time `json:"at"`
+	Stream string    `json:"stream"`
+	Line   string    `json:"line"`
+}
+
+// captureSubject describes what a command captures: the program, qualified by the interface given with -i so the
+// streams of several interfaces each replay their own captures.
+func captureSubject(program string, args []string) string {
+	subject := filepath.Base(program)
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "-i" {
+			return subject + "@" + filepath.Base(args[i+1])
+		}
+	}
+	return subject
+}
+
+// captureFileName names captures so they sort in the order they were recorded.
+func captureFileName(subject string, at time.Time) string {
+	return fmt.Sprintf("%s-%019d.jsonl", subject, at.UnixNano())
+}
+
+// RecordingTransport tees every line produced by Transport into a capture file within Dir, one file per command.
+type RecordingTransport struct {
+	Transport Transport
+	Dir       string
+}
+
+func (r *RecordingTransport) StreamCommand(ctx context.Context, bufferSize int, program string, args ...string) (output <-chan StreamLine, problem error) {
+	if err := os.MkdirAll(r.Dir, 0750); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(filepath.Join(r.Dir, captureFileName(captureSubject(program, args), time.Now())))
+	if err != nil {
+		return nil, err
+	}
+	input, err := r.Transport.StreamCommand(ctx, bufferSize, program, args...)
+	if err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+
+	lines := make(chan StreamLine, bufferSize)
+	go func() {
+		defer close(lines)
+		encoder := json.NewEncoder(file)
+		var recordProblem error
+		for line := range input {
+			record := captureRecord{At: line.At}
+			if record.At.IsZero() {
+				record.At = time.Now()
+			}
+			switch {
+			case line.Stdout != nil:
+				record.Stream, record.Line = captureStdout, *line.Stdout
+			case line.Stderr != nil:
+				record.Stream, record.Line = captureStderr, *line.Stderr
+			case line.Problem != nil:
+				record.Stream, record.Line = captureProblem, line.Problem.Error()
+			}
+			if recordProblem == nil {
+				recordProblem = encoder.Encode(record)
+			}
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+			}
+		}
+		if err := errors.Join(recordProblem, file.Close()); err != nil {
+			select {
+			case lines <- StreamLine{Problem: fmt.Errorf("recording %s: %w", file.Name(), err)}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return lines, nil
+}
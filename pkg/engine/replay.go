@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrReplayExhausted is returned once every capture of a program has been replayed.
+var ErrReplayExhausted = errors.New("replay exhausted")
+
+// replayPositions tracks the next capture to replay for each directory and capture subject.  Positions are shared across
+// ReplayTransport instances so restarted collectors continue with the following capture.
+var replayPositions = struct {
+	lock sync.Mutex
+	next map[string]int
+}{next: map[string]int{}}
+
+// ReplayTransport feeds captures written by RecordingTransport back as if the commands were running.  Each command
+// replays the next capture recorded for the same program and interface.
+type ReplayTransport struct {
+	Dir string
+	// Speed scales the delay between lines; 1 replays at the original pace, 0 replays as quickly as possible.
+	Speed float64
+	// Peek replays the next capture without consuming it, leaving it for the following command.
+	Peek bool
+}
+
+func (r *ReplayTransport) StreamCommand(ctx context.Context, bufferSize int, program string, args ...string) (output <-chan StreamLine, problem error) {
+	subject := captureSubject(program, args)
+	captures, err := filepath.Glob(filepath.Join(r.Dir, subject+"-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(captures)
+
+	key := r.Dir + "\x00" + subject
+	replayPositions.lock.Lock()
+	index := replayPositions.next[key]
+	if !r.Peek {
+		replayPositions.next[key] = index + 1
+	}
+	replayPositions.lock.Unlock()
+	if index >= len(captures) {
+		return nil, fmt.Errorf("%s in %s: %w", program, r.Dir, ErrReplayExhausted)
+	}
+
+	file, err := os.Open(captures[index])
+	if err != nil {
+		return nil, err
+	}
+	lines := make(chan StreamLine, bufferSize)
+	send := func(line StreamLine) bool {
+		select {
+		case lines <- line:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	go func() {
+		defer close(lines)
+		defer file.Close()
+
+		var previous time.Time
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			var record captureRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				send(StreamLine{Problem: fmt.Errorf("%s: %w", file.Name(), err)})
+				return
+			}
+			if r.Speed > 0 && !previous.IsZero() {
+				select {
+				case <-time.After(time.Duration(float64(record.At.Sub(previous)) / r.Speed)):
+				case <-ctx.Done():
+					return
+				}
+			}
+			previous = record.At
+
+			line := StreamLine{At: record.At}
+			switch record.Stream {
+			case captureStdout:
+				line.Stdout = &record.Line
+			case captureStderr:
+				line.Stderr = &record.Line
+			case captureProblem:
+				line.Problem = errors.New(record.Line)
+			default:
+				line.Problem = fmt.Errorf("%s: unknown stream %q", file.Name(), record.Stream)
+			}
+			if !send(line) || line.Problem != nil {
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			send(StreamLine{Problem: err})
+		}
+	}()
+	return lines, nil
+}
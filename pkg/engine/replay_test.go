@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+func collectLines(t *testing.T, lines <-chan StreamLine) (stdout []string, stderr []string) {
+	for line := range lines {
+		require.NoError(t, line.Problem)
+		if line.Stdout != nil {
+			stdout = append(stdout, *line.Stdout)
+		}
+		if line.Stderr != nil {
+			stderr = append(stderr, *line.Stderr)
+		}
+	}
+	return stdout, stderr
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	recorder := &RecordingTransport{Transport: &LocalExec{}, Dir: dir}
+	lines, err := recorder.StreamCommand(context.Background(), 1, "sh", "-c", "echo first; echo problem >&2; echo second")
+	require.NoError(t, err)
+	recordedOut, recordedErr := collectLines(t, lines)
+
+	replay := &ReplayTransport{Dir: dir, Speed: 0}
+	lines, err = replay.StreamCommand(context.Background(), 1, "sh")
+	require.NoError(t, err)
+	replayedOut, replayedErr := collectLines(t, lines)
+	assert.Equal(t, recordedOut, replayedOut)
+	assert.Equal(t, recordedErr, replayedErr)
+
+	_, err = replay.StreamCommand(context.Background(), 1, "sh")
+	assert.ErrorIs(t, err, ErrReplayExhausted)
+}
+
+func TestPeekLeavesCaptureForReplay(t *testing.T) {
+	dir := t.TempDir()
+	recorder := &RecordingTransport{Transport: &LocalExec{}, Dir: dir}
+	lines, err := recorder.StreamCommand(context.Background(), 1, "echo", "captured")
+	require.NoError(t, err)
+	collectLines(t, lines)
+
+	config := &Config{Transport: TransportReplay, ReplayDir: dir, RecordDir: t.TempDir()}
+	peek, err := NewPeekTransport(config)
+	require.NoError(t, err)
+	lines, err = peek.StreamCommand(context.Background(), 1, "echo")
+	require.NoError(t, err)
+	peeked, _ := collectLines(t, lines)
+	assert.Equal(t, []string{"captured"}, peeked)
+	recorded, err := os.ReadDir(config.RecordDir)
+	require.NoError(t, err)
+	assert.Empty(t, recorded, "peeking is not recorded")
+
+	replay, err := NewTransport(config)
+	require.NoError(t, err)
+	lines, err = replay.StreamCommand(context.Background(), 1, "echo")
+	require.NoError(t, err)
+	replayed, _ := collectLines(t, lines)
+	assert.Equal(t, peeked, replayed)
+}
+
+func TestReplayKeepsInterfacesApart(t *testing.T) {
+	dir := t.TempDir()
+	recorder := &RecordingTransport{Transport: &LocalExec{}, Dir: dir}
+	for _, iface := range []string{"igb0", "igb1"} {
+		lines, err := recorder.StreamCommand(context.Background(), 1, "sh", "-c", "echo $1", "-i", iface)
+		require.NoError(t, err)
+		collectLines(t, lines)
+	}
+
+	replay := &ReplayTransport{Dir: dir, Speed: 0}
+	for _, iface := range []string{"igb1", "igb0"} {
+		lines, err := replay.StreamCommand(context.Background(), 1, "sh", "-c", "echo $1", "-i", iface)
+		require.NoError(t, err)
+		replayed, _ := collectLines(t, lines)
+		assert.Equal(t, []string{iface}, replayed)
+	}
+	_, err := replay.StreamCommand(context.Background(), 1, "sh", "-c", "echo $1", "-i", "igb0")
+	assert.ErrorIs(t, err, ErrReplayExhausted)
+
+	// captures of the program without an interface are not shared out among interfaces
+	lines, err := recorder.StreamCommand(context.Background(), 1, "sh", "-c", "echo all")
+	require.NoError(t, err)
+	collectLines(t, lines)
+	_, err = replay.StreamCommand(context.Background(), 1, "sh", "-c", "echo $1", "-i", "igb2")
+	assert.ErrorIs(t, err, ErrReplayExhausted)
+}
+
+func TestReplayPreservesCaptureTimes(t *testing.T) {
+	dir := t.TempDir()
+	recorder := &RecordingTransport{Transport: &LocalExec{}, Dir: dir}
+	lines, err := recorder.StreamCommand(context.Background(), 1, "echo", "captured")
+	require.NoError(t, err)
+	var recordedAt time.Time
+	for line := range lines {
+		require.NoError(t, line.Problem)
+		recordedAt = line.At
+	}
+	require.False(t, recordedAt.IsZero())
+
+	replay := &ReplayTransport{Dir: dir, Speed: 0}
+	lines, err = replay.StreamCommand(context.Background(), 1, "echo")
+	require.NoError(t, err)
+	for line := range lines {
+		require.NoError(t, line.Problem)
+		assert.True(t, recordedAt.Equal(line.At), "replayed %s, recorded %s", line.At, recordedAt)
+	}
+}
@@ -2,26 +2,43 @@ package engine
 
 import (
 	"bufio"
+	"context"
 	"errors"
-	"github.com/melbahja/goph"
 	"golang.org/x/crypto/ssh"
 	"io"
+	"strings"
+	"sync"
+	"time"
 )
 
+// SSHStream runs commands on pfSense over SSH.
 type SSHStream struct {
 	Config *Config
+	// Pool provides the connection commands are run on.  DefaultPool is used when nil.
+	Pool *Pool
 }
 
-type SSHStreamLine struct {
-	Stdout  *string
-	Stderr  *string
-	Problem error
-}
+// StreamCommand runs the program remotely.  Cancelling ctx signals the remote program to terminate and closes the
+// session; callers which stop reading early must cancel ctx to release the stream.
+func (s *SSHStream) StreamCommand(ctx context.Context, bufferSize int, program string, args ...string) (output <-chan StreamLine, problem error) {
+	pool := s.Pool
+	if pool == nil {
+		pool = DefaultPool
+	}
+	lines := make(chan StreamLine, bufferSize)
+	send := func(line StreamLine) bool {
+		select {
+		case lines <- line:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
 
-func (s *SSHStream) StreamCommand(bufferSize int, program string, args ...string) (output <-chan SSHStreamLine, problem error) {
-	sync := make(chan SSHStreamLine, bufferSize)
 	go func() {
-		defer close(sync)
+		defer close(lines)
+		// the stderr reader must finish before lines is closed; closing the session guarantees it reaches EOF.
+		var stderrDone sync.WaitGroup
 		run := func() (problem error) {
 			eofTolerate := func(handle io.Closer) func() {
 				return func() {
@@ -33,60 +50,89 @@ func (s *SSHStream) StreamCommand(bufferSize int, program string, args ...string
 				}
 			}
 
-			client, err := goph.NewConn(&goph.Config{
-				User:     s.Config.PfsenseUser,
-				Addr:     s.Config.PfsenseAddress,
-				Port:     22,
-				Auth:     goph.Password(s.Config.PfsensePassword),
-				Timeout:  goph.DefaultTimeout,
-				Callback: ssh.InsecureIgnoreHostKey(),
-			})
+			session, err := pool.Session(s.Config)
 			if err != nil {
 				return err
 			}
-			defer eofTolerate(client)
+			defer eofTolerate(session)()
 
-			cmd, err := client.Command(program, args...)
-			if err != nil {
-				return err
-			}
-			defer eofTolerate(cmd)
-
-			stdin, stdInErr := cmd.StdinPipe()
-			stdout, stdOutErr := cmd.StdoutPipe()
-			stderr, stdErrErr := cmd.StderrPipe()
+			stdin, stdInErr := session.StdinPipe()
+			stdout, stdOutErr := session.StdoutPipe()
+			stderr, stdErrErr := session.StderrPipe()
 			if err := errors.Join(stdInErr, stdOutErr, stdErrErr); err != nil {
 				return err
 			}
-			defer eofTolerate(stdin)
+			defer eofTolerate(stdin)()
 
-			if err := cmd.Start(); err != nil {
+			if err := session.Start(shellCommand(program, args...)); err != nil {
 				return err
 			}
 
+			finished := make(chan struct{})
+			defer close(finished)
+			go func() {
+				select {
+				case <-ctx.Done():
+					// Closing the session alone leaves the remote program running until its next write fails.
+					_ = session.Signal(ssh.SIGTERM)
+					_ = session.Close()
+				case <-finished:
+				}
+			}()
+
+			stderrDone.Add(1)
 			go func() {
+				defer stderrDone.Done()
 				scanner := bufio.NewScanner(stderr)
 				for scanner.Scan() {
 					line := scanner.Text()
-					sync <- SSHStreamLine{Stderr: &line}
+					if !send(StreamLine{Stderr: &line, At: time.Now()}) {
+						return
+					}
 				}
 			}()
 
 			scanner := bufio.NewScanner(stdout)
 			for scanner.Scan() {
 				line := scanner.Text()
-				sync <- SSHStreamLine{
-					Stdout: &line,
+				if !send(StreamLine{Stdout: &line, At: time.Now()}) {
+					return ctx.Err()
 				}
 			}
-			return scanner.Err()
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := scanner.Err(); err != nil {
+				return err
+			}
+			return session.Wait()
 		}
 		problem := run()
+		stderrDone.Wait()
 		if problem != nil {
-			sync <- SSHStreamLine{
+			send(StreamLine{
 				Problem: problem,
-			}
+			})
 		}
 	}()
-	return sync, nil
+	return lines, nil
+}
+
+// shellCommand joins the program and its arguments into a command line for the remote shell, quoting arguments so
+// they reach the program unaltered.
+func shellCommand(program string, args ...string) string {
+	words := []string{shellQuote(program)}
+	for _, arg := range args {
+		words = append(words, shellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+func shellQuote(word string) string {
+	if word != "" && strings.IndexFunc(word, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=@%+,", r))
+	}) < 0 {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
 }
@@ -0,0 +1,181 @@
+package engine_test
+
+import (
+	"context"
+	"errors"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/engine"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/pfsensetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSSHStreamRunsCommand(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	server.Handle("netstat", pfsensetest.Command{
+		Stdout: []string{"header", "row"},
+		Stderr: []string{"warning"},
+	})
+	config := server.Config()
+	stream := &engine.SSHStream{Config: &config, Pool: engine.NewPool()}
+
+	lines, err := stream.StreamCommand(context.Background(), 8, "netstat", "-ibdnW")
+	require.NoError(t, err)
+	var stdout, stderr []string
+	for line := range lines {
+		require.NoError(t, line.Problem)
+		if line.Stdout != nil {
+			stdout = append(stdout, *line.Stdout)
+		}
+		if line.Stderr != nil {
+			stderr = append(stderr, *line.Stderr)
+		}
+	}
+	assert.Equal(t, []string{"header", "row"}, stdout)
+	assert.Equal(t, []string{"warning"}, stderr)
+	assert.Equal(t, []string{"netstat -ibdnW"}, server.Executed())
+}
+
+func TestSSHStreamQuotesArguments(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	server.Handle("iftop", pfsensetest.Command{})
+	config := server.Config()
+	stream := &engine.SSHStream{Config: &config, Pool: engine.NewPool()}
+
+	for _, args := range [][]string{
+		{"-nNbB", "-i", "igb0", "-L", "100"},
+		{"-f", "not port 873", "-f", "it's", "-f", ""},
+		{"-f", "$(reboot)"},
+	} {
+		lines, err := stream.StreamCommand(context.Background(), 8, "iftop", args...)
+		require.NoError(t, err)
+		for line := range lines {
+			require.NoError(t, line.Problem)
+		}
+	}
+	assert.Equal(t, []string{
+		"iftop -nNbB -i igb0 -L 100",
+		`iftop -f 'not port 873' -f 'it'\''s' -f ''`,
+		"iftop -f '$(reboot)'",
+	}, server.Executed())
+}
+
+func TestSSHStreamCancelSignalsRemote(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	server.Handle("iftop", pfsensetest.Command{Stdout: []string{"Listening on igb0"}, Hold: true})
+	config := server.Config()
+	stream := &engine.SSHStream{Config: &config, Pool: engine.NewPool()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lines, err := stream.StreamCommand(ctx, 0, "iftop")
+	require.NoError(t, err)
+	first := <-lines
+	require.NotNil(t, first.Stdout)
+	cancel()
+
+	closed := make(chan struct{})
+	go func() {
+		for range lines {
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("output was not closed after cancellation")
+	}
+	assert.Eventually(t, func() bool {
+		return len(server.Signals()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"TERM"}, server.Signals())
+}
+
+func TestPoolSharesAndRedialsConnections(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	server.Handle("netstat", pfsensetest.Command{Stdout: []string{"row"}})
+	config := server.Config()
+	stream := &engine.SSHStream{Config: &config, Pool: engine.NewPool()}
+
+	run := func() {
+		lines, err := stream.StreamCommand(context.Background(), 8, "netstat")
+		require.NoError(t, err)
+		for line := range lines {
+			require.NoError(t, line.Problem)
+		}
+	}
+	run()
+	run()
+	assert.Equal(t, 1, server.Connections(), "commands share a connection")
+
+	server.DropConnections()
+	run()
+	assert.Equal(t, 2, server.Connections(), "dropped connection is re-dialed")
+}
+
+func TestPoolKeepsConnectionWhenSessionRejected(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	server.MaxSessions = 1
+	server.Handle("iftop", pfsensetest.Command{Stdout: []string{"Listening on igb0"}, Hold: true})
+	server.Handle("netstat", pfsensetest.Command{Stdout: []string{"row"}})
+	config := server.Config()
+	stream := &engine.SSHStream{Config: &config, Pool: engine.NewPool()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	iftop, err := stream.StreamCommand(ctx, 0, "iftop")
+	require.NoError(t, err)
+	require.NotNil(t, (<-iftop).Stdout)
+
+	netstat, err := stream.StreamCommand(context.Background(), 8, "netstat")
+	require.NoError(t, err)
+	var problem error
+	for line := range netstat {
+		problem = errors.Join(problem, line.Problem)
+	}
+	var rejected *ssh.OpenChannelError
+	require.ErrorAs(t, problem, &rejected)
+
+	select {
+	case line, ok := <-iftop:
+		t.Fatalf("running command was disturbed: %v %v", line, ok)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, 1, server.Connections(), "connection is kept")
+}
+
+func TestSSHStreamThroughJumpHost(t *testing.T) {
+	bastion := pfsensetest.NewServer(t)
+	target := pfsensetest.NewServer(t)
+	target.Handle("netstat", pfsensetest.Command{Stdout: []string{"row"}})
+
+	config := target.Config()
+	bastionConfig := bastion.Config()
+	passwordFile := filepath.Join(t.TempDir(), "bastion-password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte(bastionConfig.PfsensePassword+"\n"), 0600))
+	config.JumpHosts = []engine.JumpHost{{
+		User:               bastionConfig.PfsenseUser,
+		Address:            bastionConfig.PfsenseAddress,
+		Port:               bastionConfig.PfsensePort,
+		PasswordFile:       passwordFile,
+		HostKeyFingerprint: bastionConfig.HostKeyFingerprint,
+	}}
+	stream := &engine.SSHStream{Config: &config, Pool: engine.NewPool()}
+
+	lines, err := stream.StreamCommand(context.Background(), 8, "netstat")
+	require.NoError(t, err)
+	var stdout []string
+	for line := range lines {
+		require.NoError(t, line.Problem)
+		if line.Stdout != nil {
+			stdout = append(stdout, *line.Stdout)
+		}
+	}
+	assert.Equal(t, []string{"row"}, stdout)
+	assert.Equal(t, []string{net.JoinHostPort(target.Address, strconv.Itoa(target.Port))}, bastion.Forwarded())
+}
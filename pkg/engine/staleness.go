@@ -0,0 +1,18 @@
+package engine
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var lastReading = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Subsystem: "collector",
+	Name:      "last_reading_timestamp_seconds",
+	Help:      "Unix time of the most recent complete reading from each collector",
+}, []string{"collector", "iface"})
+
+// RecordReading notes a complete reading from a collector, allowing frozen data to be told apart from a quiet network.
+// iface is empty for collectors covering every interface.
+func RecordReading(collector string, iface string) {
+	lastReading.WithLabelValues(collector, iface).SetToCurrentTime()
+}
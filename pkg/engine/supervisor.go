@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/iftop"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"math/rand/v2"
+	"time"
+)
+
+var streamRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Subsystem: "iftop",
+	Name:      "stream_restarts_total",
+	Help:      "Number of times the remote iftop stream has been restarted",
+}, []string{"iface"})
+
+var streamConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Subsystem: "iftop",
+	Name:      "stream_connected",
+	Help:      "1 while the remote iftop stream is producing readings, 0 while it is reconnecting",
+}, []string{"iface"})
+
+// RestartPolicy describes how a failed stream is restarted.
+type RestartPolicy struct {
+	// InitialBackoff is the delay before the first restart.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between restarts.
+	MaxBackoff time.Duration
+	// Multiplier grows the delay after each consecutive failure.
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction in either direction.
+	Jitter float64
+	// MaxAttempts is the number of consecutive failures tolerated before giving up.  Zero retries forever.
+	MaxAttempts int
+	// ResetAfter is how long a stream must run before its failures are forgiven.
+	ResetAfter time.Duration
+}
+
+func DefaultRestartPolicy() RestartPolicy {
+	return RestartPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+		Multiplier:     2,
+		Jitter:         0.2,
+		MaxAttempts:    0,
+		ResetAfter:     time.Minute,
+	}
+}
+
+// backoff is the delay before restarting after the given number of consecutive failures.
+func (r RestartPolicy) backoff(failures int) time.Duration {
+	delay := float64(r.InitialBackoff)
+	for i := 1; i < failures && delay < float64(r.MaxBackoff); i++ {
+		delay *= r.Multiplier
+	}
+	delay = min(delay, float64(r.MaxBackoff))
+	if r.Jitter > 0 {
+		delay += delay * r.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// Supervise runs the iftop stream described by config, restarting it according to policy whenever it fails.  An error
+// is only returned once the policy gives up, ctx is done, or config fails its Check or has invalid Iftop options.
+func Supervise(ctx context.Context, config *Config, policy RestartPolicy, onFrameDone iftop.OnFrameDone) error {
+	// restarting can not fix a bad command line or configuration
+	if _, err := config.Iftop.args(config.NetworkInterface); err != nil {
+		return err
+	}
+	if err := config.Check(); err != nil {
+		return err
+	}
+	return supervise(ctx, config.NetworkInterface, policy, func(ctx context.Context, connected func()) error {
+		return Run(ctx, config, func(ctx context.Context, reading *iftop.Reading, interpreter *iftop.IftopInterpreter) error {
+			connected()
+			return onFrameDone(ctx, reading, interpreter)
+		})
+	})
+}
+
+// supervise restarts run until the policy gives up.  run calls connected each time it makes progress.
+func supervise(ctx context.Context, iface string, policy RestartPolicy, run func(ctx context.Context, connected func()) error) error {
+	logger := collectorLogger("iftop", iface)
+	connected := streamConnected.WithLabelValues(iface)
+	restarts := streamRestarts.WithLabelValues(iface)
+	defer connected.Set(0)
+
+	failures := 0
+	for {
+		started := time.Now()
+		err := run(ctx, func() {
+			connected.Set(1)
+		})
+		connected.Set(0)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrReplayExhausted) {
+			return err
+		}
+		if err == nil {
+			err = errors.New("iftop exited")
+		}
+
+		if policy.ResetAfter > 0 && time.Since(started) >= policy.ResetAfter {
+			failures = 0
+		}
+		failures++
+		if policy.MaxAttempts > 0 && failures >= policy.MaxAttempts {
+			return fmt.Errorf("giving up on iftop for %s after %d consecutive failures: %w", iface, failures, err)
+		}
+
+		delay := policy.backoff(failures)
+		logger.Warn("stream failed, restarting", "delay", delay, "failures", failures, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		restarts.Inc()
+	}
+}
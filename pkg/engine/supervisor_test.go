@@ -0,0 +1,54 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	policy := RestartPolicy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second, Multiplier: 2}
+	assert.Equal(t, time.Second, policy.backoff(1))
+	assert.Equal(t, 2*time.Second, policy.backoff(2))
+	assert.Equal(t, 8*time.Second, policy.backoff(4))
+	assert.Equal(t, 10*time.Second, policy.backoff(5))
+	assert.Equal(t, 10*time.Second, policy.backoff(50))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := policy.backoff(2)
+		assert.GreaterOrEqual(t, delay, time.Second)
+		assert.LessOrEqual(t, delay, 3*time.Second)
+	}
+}
+
+func TestSuperviseGivesUpAfterMaxAttempts(t *testing.T) {
+	failure := errors.New("connection refused")
+	attempts := 0
+	err := supervise(context.Background(), "test0", RestartPolicy{
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		Multiplier:     2,
+		MaxAttempts:    3,
+	}, func(ctx context.Context, connected func()) error {
+		attempts++
+		return failure
+	})
+	assert.ErrorIs(t, err, failure)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestSuperviseStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := supervise(ctx, "test0", DefaultRestartPolicy(), func(ctx context.Context, connected func()) error {
+		attempts++
+		connected()
+		cancel()
+		return errors.New("stream closed")
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, attempts)
+}
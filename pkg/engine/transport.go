@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// TransportSSH runs commands on pfSense over SSH.
+	TransportSSH = "ssh"
+	// TransportLocal runs commands on the machine the tracker is running on, such as when deployed on the firewall.
+	TransportLocal = "local"
+	// TransportReplay replays captures recorded with Config.RecordDir.
+	TransportReplay = "replay"
+)
+
+// StreamLine is a single line of output from a command, or the problem which ended it.
+type StreamLine struct {
+	Stdout  *string
+	Stderr  *string
+	Problem error
+	// At is when the line was produced: when it was read for live commands, or when it was recorded for replays.
+	At time.Time
+}
+
+// Transport runs commands, streaming their output line by line.  The returned channel is closed once the command exits
+// or ctx is done; cancelling ctx terminates the command.
+type Transport interface {
+	StreamCommand(ctx context.Context, bufferSize int, program string, args ...string) (output <-chan StreamLine, problem error)
+}
+
+// NewTransport builds the transport selected by config.Transport, defaulting to SSH.  Output is also recorded when
+// config.RecordDir is set.
+func NewTransport(config *Config) (Transport, error) {
+	transport, err := newTransport(config, false)
+	if err != nil {
+		return nil, err
+	}
+	if config.RecordDir != "" {
+		transport = &RecordingTransport{Transport: transport, Dir: config.RecordDir}
+	}
+	return transport, nil
+}
+
+// NewPeekTransport builds the transport selected by config.Transport for looking around before collecting, such as to
+// discover interfaces.  Nothing is recorded and replays leave the capture they play for the collectors.
+func NewPeekTransport(config *Config) (Transport, error) {
+	return newTransport(config, true)
+}
+
+// Check reports problems with config which reconnecting can not fix, so they are reported when starting rather than
+// retried: an unknown transport, or SSH to pfSense or a jump host without a host key policy or with credentials which
+// can not be loaded.
+func (c *Config) Check() error {
+	if _, err := newTransport(c, false); err != nil {
+		return err
+	}
+	if c.Transport != "" && c.Transport != TransportSSH {
+		return nil
+	}
+	for _, jump := range c.JumpHosts {
+		hop, err := jump.config(c)
+		if err == nil {
+			err = hop.checkSSH()
+		}
+		if err != nil {
+			return fmt.Errorf("jump host %s: %w", jump, err)
+		}
+	}
+	return c.checkSSH()
+}
+
+// checkSSH builds the host key policy and authentication methods used when dialing.
+func (c *Config) checkSSH() error {
+	if _, err := c.hostKeyCallback(); err != nil {
+		return err
+	}
+	_, release, err := c.authMethods()
+	release()
+	return err
+}
+
+func newTransport(config *Config, peek bool) (Transport, error) {
+	var transport Transport
+	switch config.Transport {
+	case "", TransportSSH:
+		transport = &SSHStream{Config: config}
+	case TransportLocal:
+		transport = &LocalExec{}
+	case TransportReplay:
+		if config.ReplayDir == "" {
+			return nil, fmt.Errorf("the replay transport requires a replay directory")
+		}
+		transport = &ReplayTransport{Dir: config.ReplayDir, Speed: config.ReplaySpeed, Peek: peek}
+	default:
+		return nil, fmt.Errorf("unknown transport %q", config.Transport)
+	}
+	return transport, nil
+}
@@ -0,0 +1,263 @@
+package flows
+
+import (
+	"cmp"
+	"fmt"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/iftop"
+	"github.com/prometheus/client_golang/prometheus"
+	"slices"
+	"strings"
+)
+
+// Modes flows may be aggregated by before being exported.
+const (
+	// ModeFlow exports each flow between two endpoints, ports included.
+	ModeFlow = "flow"
+	// ModeHostPair sums the flows between each pair of hosts regardless of port.
+	ModeHostPair = "host-pair"
+	// ModeLocalHost sums the uploads and downloads of each local host regardless of who it was exchanged with.  Flows
+	// between two local or two remote hosts are summed as Unclassified, uploaded by iftop's source.
+	ModeLocalHost = "local-host"
+	// ModeLocalRemote sums the uploads and downloads between each local host and remote host regardless of port, flows
+	// between two local or two remote hosts being summed as Unclassified.
+	ModeLocalRemote = "local-remote"
+)
+
+// aggregation describes how flows are grouped into series for one mode.
+type aggregation struct {
+	bytes  *prometheus.Desc
+	rate   *prometheus.Desc
+	folded *prometheus.Desc
+	// directions label the traffic sent and received by a group.
+	directions [2]string
+	// other labels the group summing groups outside the top.
+	other []string
+	// group places a flow, returning the label values of its group and the traffic in each of directions.
+	group func(f *iftop.Frame, local LocalNetworks) (labels []string, sent traffic, received traffic)
+}
+
+// newAggregation builds the series for mode, named after prefix.
+func newAggregation(prefix string, what string, labels []string, directions [2]string, other []string, group func(f *iftop.Frame, local LocalNetworks) ([]string, traffic, traffic)) *aggregation {
+	labels = append([]string{"iface"}, labels...)
+	labels = append(labels, "direction")
+	return &aggregation{
+		bytes: prometheus.NewDesc(prefix+"_bytes_total",
+			"Bytes transferred in each direction of a "+what+" while exported individually rather than as part of other",
+			labels, nil),
+		rate: prometheus.NewDesc(prefix+"_rate_bytes_per_second",
+			"Average bytes per second in each direction of a "+what+" over the window",
+			append(labels[:len(labels):len(labels)], "window"), nil),
+		folded: prometheus.NewDesc(prefix+"s_folded",
+			"Number of "+what+"s outside the top, exported together as other",
+			[]string{"iface"}, nil),
+		directions: directions,
+		other:      other,
+		group:      group,
+	}
+}
+
+var aggregations = map[string]*aggregation{
+	ModeFlow: newAggregation("iftop_flow", "flow",
+		[]string{"family", "src_host", "src_port", "dst_host", "dst_port"},
+		[2]string{"src_to_dst", "dst_to_src"},
+		[]string{"", Other, "", Other, ""},
+		func(f *iftop.Frame, local LocalNetworks) ([]string, traffic, traffic) {
+			source := f.Source.AddressParts()
+			destination := f.Destination.AddressParts()
+			return []string{f.Family(), source.Host, source.Port, destination.Host, destination.Port}, trafficOf(f.Source), trafficOf(f.Destination)
+		}),
+	ModeHostPair: newAggregation("iftop_host_pair", "host pair",
+		[]string{"family", "src_host", "dst_host"},
+		[2]string{"src_to_dst", "dst_to_src"},
+		[]string{"", Other, Other},
+		func(f *iftop.Frame, local LocalNetworks) ([]string, traffic, traffic) {
+			source := f.Source.AddressParts()
+			destination := f.Destination.AddressParts()
+			return []string{f.Family(), source.Host, destination.Host}, trafficOf(f.Source), trafficOf(f.Destination)
+		}),
+	ModeLocalHost: newAggregation("iftop_local_host", "local host",
+		[]string{"family", "host"},
+		[2]string{"upload", "download"},
+		[]string{"", Other},
+		func(f *iftop.Frame, local LocalNetworks) ([]string, traffic, traffic) {
+			n := local.Normalize(f)
+			if n.Unclassified {
+				return []string{f.Family(), Unclassified}, n.upload(), n.download()
+			}
+			return []string{f.Family(), n.Local.Host}, n.upload(), n.download()
+		}),
+	ModeLocalRemote: newAggregation("iftop_local_remote", "local and remote host pair",
+		[]string{"family", "local_host", "remote_host"},
+		[2]string{"upload", "download"},
+		[]string{"", Other, Other},
+		func(f *iftop.Frame, local LocalNetworks) ([]string, traffic, traffic) {
+			n := local.Normalize(f)
+			if n.Unclassified {
+				return []string{f.Family(), Unclassified, Unclassified}, n.upload(), n.download()
+			}
+			return []string{f.Family(), n.Local.Host, n.Remote.Host}, n.upload(), n.download()
+		}),
+}
+
+func (n Normalized) upload() traffic {
+	return traffic{bytes: n.UploadBytes, rates: n.UploadRates}
+}
+
+func (n Normalized) download() traffic {
+	return traffic{bytes: n.DownloadBytes, rates: n.DownloadRates}
+}
+
+// ParseModes validates the aggregation modes, defaulting to ModeFlow when none are given.  Modes given more than once
+// are only exported once.
+func ParseModes(modes []string) ([]string, error) {
+	if len(modes) == 0 {
+		return []string{ModeFlow}, nil
+	}
+	var parsed []string
+	for _, mode := range modes {
+		if _, ok := aggregations[mode]; !ok {
+			return nil, fmt.Errorf("unknown aggregation %q, expected one of %s, %s, %s or %s", mode, ModeFlow, ModeHostPair, ModeLocalHost, ModeLocalRemote)
+		}
+		if !slices.Contains(parsed, mode) {
+			parsed = append(parsed, mode)
+		}
+	}
+	return parsed, nil
+}
+
+// group is the traffic of every flow sharing the same labels.
+type group struct {
+	key      string
+	labels   []string
+	sent     traffic
+	received traffic
+	// grew is the bytes transferred in each direction since the previous reading.
+	grew [2]float64
+}
+
+func (g *group) transferred() float64 {
+	return g.sent.bytes + g.received.bytes
+}
+
+// tally groups the flows of an interface for one mode, following each flow across readings.  Each byte a flow transfers
+// is counted once: by its group while the group is within the top, otherwise by the group for Other.  The bytes of
+// every series only ever grow, however flows are evicted and groups move in and out of the top.
+type tally struct {
+	aggregation *aggregation
+	// seen is the bytes each flow had transferred in each direction as of the previous reading.
+	seen map[string][2]float64
+	// totals are the bytes each group has transferred in each direction while within the top, by group key.  Groups are
+	// forgotten once none of their flows are tracked.
+	totals map[string][2]float64
+	// exported are the groups within the top as of the latest reading.
+	exported []*group
+	// other sums the groups outside the top, accumulating the bytes they transferred while folded.  Nil until a group
+	// has been folded.
+	other *group
+	// folded is the number of groups outside the top as of the latest reading.
+	folded int
+}
+
+func newTally(a *aggregation) *tally {
+	return &tally{aggregation: a, seen: map[string][2]float64{}, totals: map[string][2]float64{}}
+}
+
+// record regroups flows after a reading, keeping the topFlows groups which transferred the most apart from the rest, and
+// credits what each flow transferred since the previous reading to its group or to Other.  evicted are the flows
+// forgotten by the reading.
+func (t *tally) record(flows []*Flow, evicted []*Flow, local LocalNetworks, topFlows int) {
+	for _, flow := range evicted {
+		delete(t.seen, flow.Key)
+	}
+	groups := map[string]*group{}
+	var ordered []*group
+	for _, flow := range flows {
+		labels, sent, received := t.aggregation.group(flow.Frame, local)
+		key := strings.Join(labels, "\x00")
+		g, ok := groups[key]
+		if !ok {
+			g = &group{key: key, labels: labels}
+			groups[key] = g
+			ordered = append(ordered, g)
+		}
+		g.sent.add(sent)
+		g.received.add(received)
+		seen := t.seen[flow.Key]
+		g.grew[0] += grown(seen[0], sent.bytes)
+		g.grew[1] += grown(seen[1], received.bytes)
+		t.seen[flow.Key] = [2]float64{sent.bytes, received.bytes}
+	}
+
+	for key := range t.totals {
+		if _, ok := groups[key]; !ok {
+			delete(t.totals, key)
+		}
+	}
+
+	// groups are ranked by what their flows have transferred, then export what they transferred while within the top
+	top, folded := topOf(ordered, topFlows)
+	for _, g := range top {
+		total := t.totals[g.key]
+		total[0] += g.grew[0]
+		total[1] += g.grew[1]
+		t.totals[g.key] = total
+		g.sent.bytes, g.received.bytes = total[0], total[1]
+	}
+	t.exported, t.folded = top, len(folded)
+	if len(folded) > 0 && t.other == nil {
+		t.other = &group{labels: t.aggregation.other}
+	}
+	if t.other != nil {
+		t.other.sent.rates, t.other.received.rates = iftop.Rates{}, iftop.Rates{}
+		for _, g := range folded {
+			t.other.sent.add(traffic{bytes: g.grew[0], rates: g.sent.rates})
+			t.other.received.add(traffic{bytes: g.grew[1], rates: g.received.rates})
+		}
+	}
+}
+
+// grown is how many bytes a flow transferred between two readings.  Counts lower than before mean iftop has restarted
+// and counted afresh.
+func grown(before float64, now float64) float64 {
+	if now < before {
+		return now
+	}
+	return now - before
+}
+
+// topOf splits groups into the n which transferred the most and the remainder, keeping every group when n is zero.
+func topOf(groups []*group, n int) (top []*group, folded []*group) {
+	if n <= 0 || len(groups) <= n {
+		return groups, nil
+	}
+	slices.SortFunc(groups, func(a, b *group) int {
+		if order := cmp.Compare(b.transferred(), a.transferred()); order != 0 {
+			return order
+		}
+		return slices.Compare(a.labels, b.labels)
+	})
+	return groups[:n], groups[n:]
+}
+
+// collect emits the series of the groups on iface, along with the number folded when folding.
+func (t *tally) collect(metrics chan<- prometheus.Metric, iface string, folding bool) {
+	for _, g := range t.exported {
+		t.aggregation.collect(metrics, iface, g)
+	}
+	if !folding {
+		return
+	}
+	if t.other != nil {
+		t.aggregation.collect(metrics, iface, t.other)
+	}
+	metrics <- prometheus.MustNewConstMetric(t.aggregation.folded, prometheus.GaugeValue, float64(t.folded), iface)
+}
+
+// collect emits the series of a group on iface.
+func (a *aggregation) collect(metrics chan<- prometheus.Metric, iface string, g *group) {
+	for d, t := range []traffic{g.sent, g.received} {
+		labels := append(append([]string{iface}, g.labels...), a.directions[d])
+		metrics <- prometheus.MustNewConstMetric(a.bytes, prometheus.CounterValue, t.bytes, labels...)
+		collectRates(metrics, a.rate, t.rates, labels...)
+	}
+}
@@ -0,0 +1,130 @@
+package flows
+
+import (
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/iftop"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+// laptopFrames are a LAN laptop browsing on two connections to the same server, and an inbound connection to it.
+func laptopFrames() []*iftop.Frame {
+	first := frame("192.168.1.10:51234", "142.250.72.14:443")
+	first.Source.CumulativeBytes, first.Destination.CumulativeBytes = 1000, 20000
+	second := frame("192.168.1.10:51236", "142.250.72.14:443")
+	second.Source.CumulativeBytes, second.Destination.CumulativeBytes = 500, 8000
+	inbound := frame("198.51.100.7:40222", "192.168.1.10:22")
+	inbound.Source.CumulativeBytes, inbound.Destination.CumulativeBytes = 300, 700
+	return []*iftop.Frame{first, second, inbound}
+}
+
+func TestAggregateByHostPair(t *testing.T) {
+	collector, err := NewCollector(CollectorConfig{Modes: []string{ModeHostPair}})
+	require.NoError(t, err)
+	collector.Record("igb1", &iftop.Reading{Frames: laptopFrames()})
+
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP iftop_host_pair_bytes_total Bytes transferred in each direction of a host pair while exported individually rather than as part of other
+# TYPE iftop_host_pair_bytes_total counter
+iftop_host_pair_bytes_total{direction="dst_to_src",dst_host="142.250.72.14",family="ipv4",iface="igb1",src_host="192.168.1.10"} 28000
+iftop_host_pair_bytes_total{direction="src_to_dst",dst_host="142.250.72.14",family="ipv4",iface="igb1",src_host="192.168.1.10"} 1500
+iftop_host_pair_bytes_total{direction="dst_to_src",dst_host="192.168.1.10",family="ipv4",iface="igb1",src_host="198.51.100.7"} 700
+iftop_host_pair_bytes_total{direction="src_to_dst",dst_host="192.168.1.10",family="ipv4",iface="igb1",src_host="198.51.100.7"} 300
+`), "iftop_host_pair_bytes_total"))
+	assert.Zero(t, testutil.CollectAndCount(collector, "iftop_flow_bytes_total"))
+}
+
+func TestAggregateKeepsBytesOfEvictedFlows(t *testing.T) {
+	collector, err := NewCollector(CollectorConfig{Modes: []string{ModeHostPair}, TTL: time.Minute})
+	require.NoError(t, err)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	frames := laptopFrames()
+	collector.Record("igb1", &iftop.Reading{ReceivedAt: start, Frames: frames})
+	// the second connection to the server closed, expiring while the first carries on
+	first := *frames[0]
+	first.Source.CumulativeBytes = 1100
+	collector.Record("igb1", &iftop.Reading{ReceivedAt: start.Add(2 * time.Minute), Frames: []*iftop.Frame{&first, frames[2]}})
+
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP iftop_host_pair_bytes_total Bytes transferred in each direction of a host pair while exported individually rather than as part of other
+# TYPE iftop_host_pair_bytes_total counter
+iftop_host_pair_bytes_total{direction="dst_to_src",dst_host="142.250.72.14",family="ipv4",iface="igb1",src_host="192.168.1.10"} 28000
+iftop_host_pair_bytes_total{direction="src_to_dst",dst_host="142.250.72.14",family="ipv4",iface="igb1",src_host="192.168.1.10"} 1600
+iftop_host_pair_bytes_total{direction="dst_to_src",dst_host="192.168.1.10",family="ipv4",iface="igb1",src_host="198.51.100.7"} 700
+iftop_host_pair_bytes_total{direction="src_to_dst",dst_host="192.168.1.10",family="ipv4",iface="igb1",src_host="198.51.100.7"} 300
+`), "iftop_host_pair_bytes_total"))
+}
+
+func TestAggregateByLocalHost(t *testing.T) {
+	collector, err := NewCollector(CollectorConfig{Modes: []string{ModeFlow, ModeLocalHost}})
+	require.NoError(t, err)
+	collector.Record("igb1", &iftop.Reading{Frames: laptopFrames()})
+
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP iftop_local_host_bytes_total Bytes transferred in each direction of a local host while exported individually rather than as part of other
+# TYPE iftop_local_host_bytes_total counter
+iftop_local_host_bytes_total{direction="download",family="ipv4",host="192.168.1.10",iface="igb1"} 28300
+iftop_local_host_bytes_total{direction="upload",family="ipv4",host="192.168.1.10",iface="igb1"} 2200
+`), "iftop_local_host_bytes_total"))
+	assert.Equal(t, 6, testutil.CollectAndCount(collector, "iftop_flow_bytes_total"), "each mode is exported")
+}
+
+func TestAggregateUnclassifiedFlowsApart(t *testing.T) {
+	local, err := ParseLocalNetworks([]string{"192.168.1.0/24"})
+	require.NoError(t, err)
+	collector, err := NewCollector(CollectorConfig{Modes: []string{ModeLocalHost}, LocalNetworks: local})
+	require.NoError(t, err)
+	share := frame("192.168.1.10:50000", "192.168.1.20:445")
+	share.Source.CumulativeBytes, share.Destination.CumulativeBytes = 4000, 90000
+	transit := frame("198.51.100.7:40222", "142.250.72.14:443")
+	transit.Source.CumulativeBytes, transit.Destination.CumulativeBytes = 100, 200
+	collector.Record("igb1", &iftop.Reading{Frames: append(laptopFrames(), share, transit)})
+
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP iftop_local_host_bytes_total Bytes transferred in each direction of a local host while exported individually rather than as part of other
+# TYPE iftop_local_host_bytes_total counter
+iftop_local_host_bytes_total{direction="download",family="ipv4",host="192.168.1.10",iface="igb1"} 28300
+iftop_local_host_bytes_total{direction="upload",family="ipv4",host="192.168.1.10",iface="igb1"} 2200
+iftop_local_host_bytes_total{direction="download",family="ipv4",host="unclassified",iface="igb1"} 90200
+iftop_local_host_bytes_total{direction="upload",family="ipv4",host="unclassified",iface="igb1"} 4100
+`), "iftop_local_host_bytes_total"))
+}
+
+func TestAggregateByLocalAndRemoteHost(t *testing.T) {
+	local, err := ParseLocalNetworks([]string{"192.168.1.0/24"})
+	require.NoError(t, err)
+	collector, err := NewCollector(CollectorConfig{Modes: []string{ModeLocalRemote}, LocalNetworks: local})
+	require.NoError(t, err)
+	collector.Record("igb1", &iftop.Reading{Frames: laptopFrames()})
+
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP iftop_local_remote_bytes_total Bytes transferred in each direction of a local and remote host pair while exported individually rather than as part of other
+# TYPE iftop_local_remote_bytes_total counter
+iftop_local_remote_bytes_total{direction="download",family="ipv4",iface="igb1",local_host="192.168.1.10",remote_host="142.250.72.14"} 28000
+iftop_local_remote_bytes_total{direction="upload",family="ipv4",iface="igb1",local_host="192.168.1.10",remote_host="142.250.72.14"} 1500
+iftop_local_remote_bytes_total{direction="download",family="ipv4",iface="igb1",local_host="192.168.1.10",remote_host="198.51.100.7"} 300
+iftop_local_remote_bytes_total{direction="upload",family="ipv4",iface="igb1",local_host="192.168.1.10",remote_host="198.51.100.7"} 700
+`), "iftop_local_remote_bytes_total"))
+}
+
+func TestParseModesRejectsUnknown(t *testing.T) {
+	modes, err := ParseModes(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{ModeFlow}, modes)
+	_, err = ParseModes([]string{ModeLocalHost, "subnet"})
+	assert.Error(t, err)
+}
+
+func TestParseModesIgnoresRepeats(t *testing.T) {
+	modes, err := ParseModes([]string{ModeFlow, ModeLocalHost, ModeFlow})
+	require.NoError(t, err)
+	assert.Equal(t, []string{ModeFlow, ModeLocalHost}, modes)
+
+	collector, err := NewCollector(CollectorConfig{Modes: []string{ModeFlow, ModeFlow}})
+	require.NoError(t, err)
+	collector.Record("igb1", &iftop.Reading{Frames: laptopFrames()})
+	assert.Equal(t, 6, testutil.CollectAndCount(collector, "iftop_flow_bytes_total"))
+}
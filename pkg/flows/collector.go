@@ -0,0 +1,169 @@
+package flows
+
+import (
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/iftop"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+var (
+	interfaceRate = prometheus.NewDesc("iftop_interface_rate_bytes_per_second",
+		"Average bytes per second over the window across all flows on the interface",
+		[]string{"iface", "direction", "window"}, nil)
+	interfacePeakRate = prometheus.NewDesc("iftop_interface_peak_rate_bytes_per_second",
+		"Highest bytes per second on the interface since iftop started",
+		[]string{"iface", "direction"}, nil)
+	interfaceBytes = prometheus.NewDesc("iftop_interface_bytes_total",
+		"Bytes transferred on the interface since iftop started",
+		[]string{"iface", "direction"}, nil)
+)
+
+// Other labels the hosts of the series summing groups outside the top.
+const Other = "other"
+
+// CollectorConfig tunes which flows a Collector exports.
+type CollectorConfig struct {
+	// TTL is how long a flow is exported after it last appeared; flows never expire when zero.
+	TTL time.Duration
+	// MaxFlows bounds the flows tracked per interface; unbounded when zero.
+	MaxFlows int
+	// TopFlows is the number of flows, or groups of flows in the coarser modes, exported individually per interface,
+	// ranked by bytes transferred.  The remainder are summed into a single series for Other hosts, keeping the series per
+	// interface within budget while totals still add up: each byte is counted by its group while the group is within the
+	// top, and by Other while it is not.  Everything is exported when zero.
+	TopFlows int
+	// Modes lists how flows are aggregated, each exported as its own metrics; ModeFlow when empty.
+	Modes []string
+	// LocalNetworks tell local hosts from remote hosts when flows are aggregated around local hosts.
+	LocalNetworks LocalNetworks
+}
+
+// snapshot is the latest state of an interface.
+type snapshot struct {
+	tracker *Tracker
+	totals  iftop.Totals
+	// tallies group the flows for each mode.
+	tallies map[string]*tally
+}
+
+// Collector exports the flows and totals most recently reported by iftop on each interface.  Series are built from
+// the latest reading when scraped, so flows which are no longer tracked disappear without being unregistered.
+type Collector struct {
+	config CollectorConfig
+
+	lock       sync.Mutex
+	interfaces map[string]*snapshot
+}
+
+func NewCollector(config CollectorConfig) (*Collector, error) {
+	modes, err := ParseModes(config.Modes)
+	if err != nil {
+		return nil, err
+	}
+	config.Modes = modes
+	return &Collector{
+		config:     config,
+		interfaces: map[string]*snapshot{},
+	}, nil
+}
+
+// Record replaces the snapshot of iface with reading.
+func (c *Collector) Record(iface string, reading *iftop.Reading) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s, ok := c.interfaces[iface]
+	if !ok {
+		s = &snapshot{tracker: NewTracker(iface, c.config.TTL, c.config.MaxFlows), tallies: map[string]*tally{}}
+		for _, mode := range c.config.Modes {
+			s.tallies[mode] = newTally(aggregations[mode])
+		}
+		c.interfaces[iface] = s
+	}
+	s.totals = reading.Totals
+	evicted := s.tracker.Observe(reading)
+	flows := s.tracker.Flows()
+	for _, t := range s.tallies {
+		t.record(flows, evicted, c.config.LocalNetworks, c.config.TopFlows)
+	}
+}
+
+// Forget stops exporting iface, such as once its stream has been abandoned.
+func (c *Collector) Forget(iface string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if s, ok := c.interfaces[iface]; ok {
+		s.tracker.Clear()
+		delete(c.interfaces, iface)
+	}
+}
+
+func (c *Collector) Describe(descriptions chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{interfaceRate, interfacePeakRate, interfaceBytes} {
+		descriptions <- d
+	}
+	for _, mode := range c.config.Modes {
+		a := aggregations[mode]
+		descriptions <- a.bytes
+		descriptions <- a.rate
+		if c.config.TopFlows > 0 {
+			descriptions <- a.folded
+		}
+	}
+}
+
+func (c *Collector) Collect(metrics chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for iface, s := range c.interfaces {
+		collectTotals(metrics, iface, s.totals)
+		for _, mode := range c.config.Modes {
+			s.tallies[mode].collect(metrics, iface, c.config.TopFlows > 0)
+		}
+	}
+}
+
+// traffic is what one or more flows transferred in a single direction.
+type traffic struct {
+	bytes float64
+	rates iftop.Rates
+}
+
+func trafficOf(direction iftop.BandwidthDirection) traffic {
+	return traffic{bytes: direction.CumulativeBytes, rates: direction.Rates}
+}
+
+func (t *traffic) add(other traffic) {
+	t.bytes += other.bytes
+	t.rates.Last2 += other.rates.Last2
+	t.rates.Last10 += other.rates.Last10
+	t.rates.Last40 += other.rates.Last40
+}
+
+func collectTotals(metrics chan<- prometheus.Metric, iface string, totals iftop.Totals) {
+	for direction, rates := range map[string]iftop.Rates{"send": totals.SendRate, "receive": totals.ReceiveRate, "total": totals.TotalRate} {
+		collectRates(metrics, interfaceRate, rates, iface, direction)
+	}
+	for _, direction := range []string{"send", "receive", "total"} {
+		metrics <- prometheus.MustNewConstMetric(interfacePeakRate, prometheus.GaugeValue, sumOf(totals.PeakRate, direction), iface, direction)
+		metrics <- prometheus.MustNewConstMetric(interfaceBytes, prometheus.CounterValue, sumOf(totals.Cumulative, direction), iface, direction)
+	}
+}
+
+func sumOf(sums iftop.Sums, direction string) float64 {
+	switch direction {
+	case "send":
+		return sums.Sent
+	case "receive":
+		return sums.Received
+	default:
+		return sums.Total
+	}
+}
+
+// collectRates emits a series per window, labelled after labels.
+func collectRates(metrics chan<- prometheus.Metric, desc *prometheus.Desc, rates iftop.Rates, labels ...string) {
+	for window, rate := range map[string]float64{"2s": rates.Last2, "10s": rates.Last10, "40s": rates.Last40} {
+		metrics <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, rate, append(labels[:len(labels):len(labels)], window)...)
+	}
+}
@@ -0,0 +1,173 @@
+package flows
+
+import (
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/iftop"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectorExportsLatestFlows(t *testing.T) {
+	collector, err := NewCollector(CollectorConfig{TTL: time.Minute})
+	require.NoError(t, err)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	web := frame("192.168.1.10:51234", "142.250.72.14:443")
+	web.Source.CumulativeBytes = 2816
+	web.Destination.CumulativeBytes = 31744
+	ssh := frame("[2001:db8::22]:22", "[2001:db8::5]:60001")
+	ssh.Source.CumulativeBytes = 745
+	collector.Record("igb0", &iftop.Reading{ReceivedAt: start, Frames: []*iftop.Frame{web, ssh}, Totals: iftop.Totals{
+		Cumulative: iftop.Sums{Sent: 3584, Received: 32256, Total: 35840},
+	}})
+	// ssh has gone quiet for longer than the TTL
+	collector.Record("igb0", &iftop.Reading{ReceivedAt: start.Add(2 * time.Minute), Frames: []*iftop.Frame{web}})
+
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP iftop_flow_bytes_total Bytes transferred in each direction of a flow while exported individually rather than as part of other
+# TYPE iftop_flow_bytes_total counter
+iftop_flow_bytes_total{direction="dst_to_src",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234"} 31744
+iftop_flow_bytes_total{direction="src_to_dst",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234"} 2816
+`), "iftop_flow_bytes_total"))
+	assert.Equal(t, 6, testutil.CollectAndCount(collector, "iftop_flow_rate_bytes_per_second"))
+
+	collector.Forget("igb0")
+	assert.Equal(t, 0, testutil.CollectAndCount(collector))
+}
+
+func TestCollectorFoldsFlowsOutsideTop(t *testing.T) {
+	collector, err := NewCollector(CollectorConfig{TopFlows: 1})
+	require.NoError(t, err)
+	web := frame("192.168.1.10:51234", "142.250.72.14:443")
+	web.Source.CumulativeBytes = 2816
+	web.Destination.CumulativeBytes = 31744
+	var frames []*iftop.Frame
+	frames = append(frames, web)
+	for port := 1; port <= 3; port++ {
+		probe := frame("203.0.113.66:40000", "192.168.1.1:"+strconv.Itoa(port))
+		probe.Source.CumulativeBytes = 60
+		probe.Source.Rates = iftop.Rates{Last2: 30, Last10: 6, Last40: 1.5}
+		frames = append(frames, probe)
+	}
+	collector.Record("igb0", &iftop.Reading{Frames: frames})
+
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP iftop_flow_bytes_total Bytes transferred in each direction of a flow while exported individually rather than as part of other
+# TYPE iftop_flow_bytes_total counter
+iftop_flow_bytes_total{direction="dst_to_src",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234"} 31744
+iftop_flow_bytes_total{direction="src_to_dst",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234"} 2816
+iftop_flow_bytes_total{direction="dst_to_src",dst_host="other",dst_port="",family="",iface="igb0",src_host="other",src_port=""} 0
+iftop_flow_bytes_total{direction="src_to_dst",dst_host="other",dst_port="",family="",iface="igb0",src_host="other",src_port=""} 180
+# HELP iftop_flows_folded Number of flows outside the top, exported together as other
+# TYPE iftop_flows_folded gauge
+iftop_flows_folded{iface="igb0"} 3
+`), "iftop_flow_bytes_total", "iftop_flows_folded"))
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP iftop_flow_rate_bytes_per_second Average bytes per second in each direction of a flow over the window
+# TYPE iftop_flow_rate_bytes_per_second gauge
+iftop_flow_rate_bytes_per_second{direction="dst_to_src",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234",window="2s"} 0
+iftop_flow_rate_bytes_per_second{direction="dst_to_src",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234",window="10s"} 0
+iftop_flow_rate_bytes_per_second{direction="dst_to_src",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234",window="40s"} 0
+iftop_flow_rate_bytes_per_second{direction="src_to_dst",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234",window="2s"} 0
+iftop_flow_rate_bytes_per_second{direction="src_to_dst",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234",window="10s"} 0
+iftop_flow_rate_bytes_per_second{direction="src_to_dst",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234",window="40s"} 0
+iftop_flow_rate_bytes_per_second{direction="dst_to_src",dst_host="other",dst_port="",family="",iface="igb0",src_host="other",src_port="",window="2s"} 0
+iftop_flow_rate_bytes_per_second{direction="dst_to_src",dst_host="other",dst_port="",family="",iface="igb0",src_host="other",src_port="",window="10s"} 0
+iftop_flow_rate_bytes_per_second{direction="dst_to_src",dst_host="other",dst_port="",family="",iface="igb0",src_host="other",src_port="",window="40s"} 0
+iftop_flow_rate_bytes_per_second{direction="src_to_dst",dst_host="other",dst_port="",family="",iface="igb0",src_host="other",src_port="",window="2s"} 90
+iftop_flow_rate_bytes_per_second{direction="src_to_dst",dst_host="other",dst_port="",family="",iface="igb0",src_host="other",src_port="",window="10s"} 18
+iftop_flow_rate_bytes_per_second{direction="src_to_dst",dst_host="other",dst_port="",family="",iface="igb0",src_host="other",src_port="",window="40s"} 4.5
+`), "iftop_flow_rate_bytes_per_second"))
+}
+
+func TestCollectorKeepsOtherGrowingAsFlowsLeaveTop(t *testing.T) {
+	collector, err := NewCollector(CollectorConfig{TopFlows: 1})
+	require.NoError(t, err)
+	web := frame("192.168.1.10:51234", "142.250.72.14:443")
+	web.Source.CumulativeBytes = 1000
+	upload := frame("192.168.1.11:50000", "93.184.216.34:443")
+	upload.Source.CumulativeBytes = 990
+	dns := frame("192.168.1.12:50001", "93.184.216.34:53")
+	dns.Source.CumulativeBytes = 10
+	collector.Record("igb0", &iftop.Reading{Frames: []*iftop.Frame{web, upload, dns}})
+
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP iftop_flow_bytes_total Bytes transferred in each direction of a flow while exported individually rather than as part of other
+# TYPE iftop_flow_bytes_total counter
+iftop_flow_bytes_total{direction="dst_to_src",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234"} 0
+iftop_flow_bytes_total{direction="src_to_dst",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234"} 1000
+iftop_flow_bytes_total{direction="dst_to_src",dst_host="other",dst_port="",family="",iface="igb0",src_host="other",src_port=""} 0
+iftop_flow_bytes_total{direction="src_to_dst",dst_host="other",dst_port="",family="",iface="igb0",src_host="other",src_port=""} 1000
+`), "iftop_flow_bytes_total"))
+
+	// the upload overtakes web, which is folded into other having transferred nothing further.  The upload's earlier
+	// bytes were counted by other, so its own series only counts what it transferred since.
+	upload, dns = frame(upload.Source.Address, upload.Destination.Address), frame(dns.Source.Address, dns.Destination.Address)
+	upload.Source.CumulativeBytes = 1010
+	dns.Source.CumulativeBytes = 30
+	collector.Record("igb0", &iftop.Reading{Frames: []*iftop.Frame{web, upload, dns}})
+
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP iftop_flow_bytes_total Bytes transferred in each direction of a flow while exported individually rather than as part of other
+# TYPE iftop_flow_bytes_total counter
+iftop_flow_bytes_total{direction="dst_to_src",dst_host="93.184.216.34",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.11",src_port="50000"} 0
+iftop_flow_bytes_total{direction="src_to_dst",dst_host="93.184.216.34",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.11",src_port="50000"} 20
+iftop_flow_bytes_total{direction="dst_to_src",dst_host="other",dst_port="",family="",iface="igb0",src_host="other",src_port=""} 0
+iftop_flow_bytes_total{direction="src_to_dst",dst_host="other",dst_port="",family="",iface="igb0",src_host="other",src_port=""} 1020
+`), "iftop_flow_bytes_total"))
+}
+
+func TestCollectorCountsBytesOnceAsFlowsReturnToTop(t *testing.T) {
+	collector, err := NewCollector(CollectorConfig{TopFlows: 1})
+	require.NoError(t, err)
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+	// exported holds the latest bytes of every series exported so far, including those since folded into other
+	exported := map[string]float64{}
+	record := func(a float64, b float64) {
+		first := frame("192.168.1.10:51234", "142.250.72.14:443")
+		first.Source.CumulativeBytes = a
+		second := frame("192.168.1.11:50000", "93.184.216.34:443")
+		second.Source.CumulativeBytes = b
+		collector.Record("igb0", &iftop.Reading{Frames: []*iftop.Frame{first, second}})
+
+		families, err := registry.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() != "iftop_flow_bytes_total" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				var series []string
+				for _, label := range metric.GetLabel() {
+					series = append(series, label.GetName()+"="+label.GetValue())
+				}
+				exported[strings.Join(series, ",")] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+
+	// the first flow is within the top, folded, then back within the top
+	record(100, 10)
+	record(100, 200)
+	record(150, 200)
+	record(400, 200)
+
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP iftop_flow_bytes_total Bytes transferred in each direction of a flow while exported individually rather than as part of other
+# TYPE iftop_flow_bytes_total counter
+iftop_flow_bytes_total{direction="dst_to_src",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234"} 0
+iftop_flow_bytes_total{direction="src_to_dst",dst_host="142.250.72.14",dst_port="443",family="ipv4",iface="igb0",src_host="192.168.1.10",src_port="51234"} 350
+iftop_flow_bytes_total{direction="dst_to_src",dst_host="other",dst_port="",family="",iface="igb0",src_host="other",src_port=""} 0
+iftop_flow_bytes_total{direction="src_to_dst",dst_host="other",dst_port="",family="",iface="igb0",src_host="other",src_port=""} 60
+`), "iftop_flow_bytes_total"))
+	var total float64
+	for _, bytes := range exported {
+		total += bytes
+	}
+	assert.Equal(t, 600.0, total, "every byte is counted once across the series")
+}
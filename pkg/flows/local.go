@@ -0,0 +1,86 @@
+package flows
+
+import (
+	"fmt"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/iftop"
+	"net/netip"
+)
+
+// Unclassified labels the hosts of flows which can not be told apart as local and remote, both or neither being local.
+const Unclassified = "unclassified"
+
+// LocalNetworks are the networks whose hosts are local.  Without any networks, hosts with private, link local, or
+// loopback addresses are considered local.
+type LocalNetworks []netip.Prefix
+
+// ParseLocalNetworks parses networks given as address/prefix length.
+func ParseLocalNetworks(networks []string) (LocalNetworks, error) {
+	var local LocalNetworks
+	for _, network := range networks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("local network %q: %w", network, err)
+		}
+		local = append(local, prefix.Masked())
+	}
+	return local, nil
+}
+
+// Contains reports whether host is local.
+func (l LocalNetworks) Contains(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	if len(l) == 0 {
+		return addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLoopback()
+	}
+	for _, network := range l {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalized is a flow seen from its local host, regardless of which side iftop printed first.
+type Normalized struct {
+	Local  iftop.AddressParts
+	Remote iftop.AddressParts
+	// UploadBytes were sent by the local host since iftop started.
+	UploadBytes float64
+	// DownloadBytes were received by the local host since iftop started.
+	DownloadBytes float64
+	UploadRates   iftop.Rates
+	DownloadRates iftop.Rates
+	// Unclassified is set when both or neither host is local, leaving iftop's source as the local host.
+	Unclassified bool
+}
+
+// Normalize orients f around its local host.  Flows where neither or both hosts are local are marked Unclassified rather
+// than credited to either host.
+func (l LocalNetworks) Normalize(f *iftop.Frame) Normalized {
+	source := f.Source.AddressParts()
+	destination := f.Destination.AddressParts()
+	sourceLocal, destinationLocal := l.Contains(source.Host), l.Contains(destination.Host)
+	if destinationLocal && !sourceLocal {
+		return Normalized{
+			Local:         destination,
+			Remote:        source,
+			UploadBytes:   f.Destination.CumulativeBytes,
+			DownloadBytes: f.Source.CumulativeBytes,
+			UploadRates:   f.Destination.Rates,
+			DownloadRates: f.Source.Rates,
+		}
+	}
+	return Normalized{
+		Local:         source,
+		Remote:        destination,
+		UploadBytes:   f.Source.CumulativeBytes,
+		DownloadBytes: f.Destination.CumulativeBytes,
+		UploadRates:   f.Source.Rates,
+		DownloadRates: f.Destination.Rates,
+		Unclassified:  sourceLocal == destinationLocal,
+	}
+}
@@ -0,0 +1,68 @@
+package flows
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestLocalNetworksContains(t *testing.T) {
+	local, err := ParseLocalNetworks([]string{"10.20.0.1/16", "2001:db8:85a3:1234::/64"})
+	require.NoError(t, err)
+	for host, expected := range map[string]bool{
+		"10.20.3.4":              true,
+		"::ffff:10.20.3.4":       true,
+		"10.21.0.1":              false,
+		"192.168.1.10":           false,
+		"2001:db8:85a3:1234::10": true,
+		"2001:db8:85a3:1235::10": false,
+		"fe80::1%igb1":           false,
+		"printer.lan":            false,
+	} {
+		assert.Equal(t, expected, local.Contains(host), host)
+	}
+
+	var guessed LocalNetworks
+	for host, expected := range map[string]bool{
+		"192.168.1.10":  true,
+		"fe80::1%igb1":  true,
+		"127.0.0.1":     true,
+		"142.250.72.14": false,
+		"printer.lan":   false,
+	} {
+		assert.Equal(t, expected, guessed.Contains(host), host)
+	}
+
+	_, err = ParseLocalNetworks([]string{"10.20.0.0"})
+	assert.Error(t, err)
+}
+
+func TestNormalizeOrientsAroundLocalHost(t *testing.T) {
+	local, err := ParseLocalNetworks([]string{"203.0.113.0/24"})
+	require.NoError(t, err)
+
+	outbound := frame("203.0.113.7:51234", "142.250.72.14:443")
+	outbound.Source.CumulativeBytes, outbound.Destination.CumulativeBytes = 1000, 20000
+	n := local.Normalize(outbound)
+	assert.Equal(t, "203.0.113.7", n.Local.Host)
+	assert.Equal(t, "142.250.72.14", n.Remote.Host)
+	assert.Equal(t, 1000.0, n.UploadBytes)
+	assert.Equal(t, 20000.0, n.DownloadBytes)
+
+	inbound := frame("198.51.100.7:40222", "203.0.113.7:22")
+	inbound.Source.CumulativeBytes, inbound.Destination.CumulativeBytes = 300, 700
+	n = local.Normalize(inbound)
+	assert.Equal(t, "203.0.113.7", n.Local.Host)
+	assert.Equal(t, "22", n.Local.Port)
+	assert.Equal(t, "198.51.100.7", n.Remote.Host)
+	assert.Equal(t, 700.0, n.UploadBytes)
+	assert.Equal(t, 300.0, n.DownloadBytes)
+
+	assert.False(t, n.Unclassified)
+
+	// without a single local side the flow can not be oriented
+	transit := frame("198.51.100.7:40222", "142.250.72.14:443")
+	assert.True(t, local.Normalize(transit).Unclassified)
+	lan := frame("203.0.113.7:445", "203.0.113.9:50000")
+	assert.True(t, local.Normalize(lan).Unclassified)
+}
@@ -0,0 +1,147 @@
+// Package flows follows the flows iftop reports across readings, forgetting those which are no longer active.
+package flows
+
+import (
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/iftop"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Reasons a flow is evicted.
+const (
+	EvictedExpired  = "expired"
+	EvictedCapacity = "capacity"
+)
+
+var activeFlows = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Subsystem: "flows",
+	Name:      "active",
+	Help:      "Number of flows currently tracked and exported",
+}, []string{"iface"})
+
+var evictedFlows = promauto.NewCounterVec(prometheus.CounterOpts{
+	Subsystem: "flows",
+	Name:      "evicted_total",
+	Help:      "Number of flows forgotten, either having expired or to stay within the flow limit",
+}, []string{"iface", "reason"})
+
+// Flow is the most recent report of traffic between two endpoints.
+type Flow struct {
+	// Key identifies the flow by its endpoints.
+	Key string
+	// Frame is the flow's most recent report.  Once the flow is missing from a reading its rates are zeroed, as it is no
+	// longer transferring, while its cumulative bytes are kept.
+	Frame *iftop.Frame
+	// LastSeen is when the flow last appeared in a reading.
+	LastSeen time.Time
+}
+
+// Key identifies the flow reported by a frame.
+func Key(f *iftop.Frame) string {
+	return f.Source.Address + " " + f.Destination.Address
+}
+
+// Tracker holds the latest report of every active flow on an interface.  Flows absent from iftop's output for longer
+// than TTL are evicted, as are the least recently seen flows once there are more than MaxFlows.
+type Tracker struct {
+	Interface string
+	// TTL is how long a flow is kept after it last appeared; flows never expire when zero.
+	TTL time.Duration
+	// MaxFlows bounds the number of flows tracked; unbounded when zero.
+	MaxFlows int
+
+	lock  sync.Mutex
+	flows map[string]*Flow
+}
+
+func NewTracker(iface string, ttl time.Duration, maxFlows int) *Tracker {
+	return &Tracker{
+		Interface: iface,
+		TTL:       ttl,
+		MaxFlows:  maxFlows,
+		flows:     map[string]*Flow{},
+	}
+}
+
+// Observe records the flows in reading, returning those evicted as a result.
+func (t *Tracker) Observe(reading *iftop.Reading) (evicted []*Flow) {
+	now := reading.ReceivedAt
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, f := range reading.Frames {
+		key := Key(f)
+		flow, ok := t.flows[key]
+		if !ok {
+			flow = &Flow{Key: key}
+			t.flows[key] = flow
+		}
+		flow.Frame = f
+		flow.LastSeen = now
+	}
+	for _, flow := range t.flows {
+		if !flow.LastSeen.Equal(now) && (flow.Frame.Source.Rates != iftop.Rates{} || flow.Frame.Destination.Rates != iftop.Rates{}) {
+			quiet := *flow.Frame
+			quiet.Source.Rates = iftop.Rates{}
+			quiet.Destination.Rates = iftop.Rates{}
+			flow.Frame = &quiet
+		}
+	}
+
+	if t.TTL > 0 {
+		for key, flow := range t.flows {
+			if now.Sub(flow.LastSeen) > t.TTL {
+				delete(t.flows, key)
+				evicted = append(evicted, flow)
+			}
+		}
+		evictedFlows.WithLabelValues(t.Interface, EvictedExpired).Add(float64(len(evicted)))
+	}
+	if t.MaxFlows > 0 && len(t.flows) > t.MaxFlows {
+		oldest := make([]*Flow, 0, len(t.flows))
+		for _, flow := range t.flows {
+			oldest = append(oldest, flow)
+		}
+		slices.SortFunc(oldest, func(a, b *Flow) int {
+			return a.LastSeen.Compare(b.LastSeen)
+		})
+		excess := oldest[:len(oldest)-t.MaxFlows]
+		for _, flow := range excess {
+			delete(t.flows, flow.Key)
+		}
+		evicted = append(evicted, excess...)
+		evictedFlows.WithLabelValues(t.Interface, EvictedCapacity).Add(float64(len(excess)))
+	}
+	activeFlows.WithLabelValues(t.Interface).Set(float64(len(t.flows)))
+	return evicted
+}
+
+// Flows lists the flows currently tracked, in no particular order.
+func (t *Tracker) Flows() []*Flow {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	flows := make([]*Flow, 0, len(t.flows))
+	for _, flow := range t.flows {
+		flows = append(flows, flow)
+	}
+	return flows
+}
+
+// Clear forgets every flow, returning those which were tracked.
+func (t *Tracker) Clear() []*Flow {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	flows := make([]*Flow, 0, len(t.flows))
+	for _, flow := range t.flows {
+		flows = append(flows, flow)
+	}
+	clear(t.flows)
+	activeFlows.WithLabelValues(t.Interface).Set(0)
+	return flows
+}
@@ -0,0 +1,82 @@
+package flows
+
+import (
+	"fmt"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/iftop"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func frame(source string, destination string) *iftop.Frame {
+	return &iftop.Frame{
+		Source:      iftop.BandwidthDirection{Address: source},
+		Destination: iftop.BandwidthDirection{Address: destination},
+	}
+}
+
+func keys(flows []*Flow) []string {
+	var keys []string
+	for _, flow := range flows {
+		keys = append(keys, flow.Key)
+	}
+	return keys
+}
+
+func TestTrackerExpiresQuietFlows(t *testing.T) {
+	tracker := NewTracker("igb0", time.Minute, 0)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	web := frame("192.168.1.10:51234", "142.250.72.14:443")
+	ssh := frame("192.168.1.22:22", "192.168.1.5:60001")
+
+	assert.Empty(t, tracker.Observe(&iftop.Reading{ReceivedAt: start, Frames: []*iftop.Frame{web, ssh}}))
+	assert.Empty(t, tracker.Observe(&iftop.Reading{ReceivedAt: start.Add(time.Minute), Frames: []*iftop.Frame{web}}))
+	evicted := tracker.Observe(&iftop.Reading{ReceivedAt: start.Add(61 * time.Second), Frames: []*iftop.Frame{web}})
+	assert.Equal(t, []string{Key(ssh)}, keys(evicted))
+	assert.Equal(t, []string{Key(web)}, keys(tracker.Flows()))
+}
+
+func TestTrackerZeroesRatesOfMissingFlows(t *testing.T) {
+	tracker := NewTracker("igb0", time.Minute, 0)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	web := frame("192.168.1.10:51234", "142.250.72.14:443")
+	web.Source.Rates = iftop.Rates{Last2: 1280, Last10: 1126, Last40: 1126}
+	web.Source.CumulativeBytes = 2816
+	ssh := frame("192.168.1.22:22", "192.168.1.5:60001")
+
+	tracker.Observe(&iftop.Reading{ReceivedAt: start, Frames: []*iftop.Frame{web, ssh}})
+	tracker.Observe(&iftop.Reading{ReceivedAt: start.Add(2 * time.Second), Frames: []*iftop.Frame{ssh}})
+	for _, flow := range tracker.Flows() {
+		if flow.Key == Key(web) {
+			assert.Equal(t, iftop.Rates{}, flow.Frame.Source.Rates, "a missing flow is no longer transferring")
+			assert.Equal(t, 2816.0, flow.Frame.Source.CumulativeBytes)
+		}
+	}
+	assert.Equal(t, 1280.0, web.Source.Rates.Last2, "the reading itself is left alone")
+}
+
+func TestTrackerBoundsFlows(t *testing.T) {
+	tracker := NewTracker("igb0", 0, 2)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, address := range []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1"} {
+		evicted := tracker.Observe(&iftop.Reading{ReceivedAt: start.Add(time.Duration(i) * time.Second), Frames: []*iftop.Frame{frame(address, "10.0.0.9:80")}})
+		if i < 2 {
+			assert.Empty(t, evicted)
+		} else {
+			assert.Equal(t, []string{"10.0.0.1:1 10.0.0.9:80"}, keys(evicted), "least recently seen is evicted")
+		}
+	}
+	assert.ElementsMatch(t, []string{"10.0.0.2:1 10.0.0.9:80", "10.0.0.3:1 10.0.0.9:80"}, keys(tracker.Flows()))
+}
+
+func TestTrackerUnderChurn(t *testing.T) {
+	tracker := NewTracker("igb0", 10*time.Second, 0)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	evicted := 0
+	for i := 0; i < 10000; i++ {
+		address := fmt.Sprintf("10.0.0.1:%d", i)
+		evicted += len(tracker.Observe(&iftop.Reading{ReceivedAt: start.Add(time.Duration(i) * time.Second), Frames: []*iftop.Frame{frame(address, "10.0.0.9:80")}}))
+		assert.LessOrEqual(t, len(tracker.Flows()), 11)
+	}
+	assert.Equal(t, 10000-11, evicted)
+}
@@ -1,6 +1,12 @@
 package iftop
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
 
 type ByteReading string
 
@@ -9,22 +15,64 @@ const ScaleMB = ScaleKB * 1024
 const ScaleGB = ScaleMB * 1024
 const ScaleTB = ScaleGB * 1024
 
+// UnitBase is the multiplier between successive unit prefixes.  iftop scales by 1024 unless built or configured
+// otherwise.
+type UnitBase float64
+
+const (
+	BinaryUnits  UnitBase = 1024
+	DecimalUnits UnitBase = 1000
+)
+
+// ErrMalformedReading is returned when a reading does not follow iftop's number and unit format.
+var ErrMalformedReading = errors.New("malformed byte reading")
+
+// prefixes maps unit prefixes to their power of the unit base.
+var prefixes = map[string]int{"": 0, "K": 1, "M": 2, "G": 3, "T": 4, "P": 5}
+
+// Bytes parses a reading such as 12.4KB or 3.1Mb into bytes.  Units ending in an upper case B are bytes, as printed by
+// iftop -B; units ending in a lower case b are bits.
+func (b ByteReading) Bytes(base UnitBase) (float64, error) {
+	text := strings.TrimSpace(string(b))
+	split := strings.IndexFunc(text, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if split < 0 {
+		return 0, fmt.Errorf("%w: %q has no unit", ErrMalformedReading, string(b))
+	}
+	number, unit := text[:split], text[split:]
+	if strings.Count(number, ".") > 1 || strings.Trim(number, ".") == "" {
+		return 0, fmt.Errorf("%w: %q has no valid number", ErrMalformedReading, string(b))
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q: %w", ErrMalformedReading, string(b), err)
+	}
+
+	bits := false
+	switch {
+	case strings.HasSuffix(unit, "B"):
+	case strings.HasSuffix(unit, "b"):
+		bits = true
+	default:
+		return 0, fmt.Errorf("%w: %q has unknown unit %q", ErrMalformedReading, string(b), unit)
+	}
+	power, ok := prefixes[unit[:len(unit)-1]]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q has unknown unit %q", ErrMalformedReading, string(b), unit)
+	}
+	value *= math.Pow(float64(base), float64(power))
+	if bits {
+		value /= 8
+	}
+	return value, nil
+}
+
+// ToFloat64 parses the reading as bytes scaled by 1024, returning 0 for malformed readings.
 func (b ByteReading) ToFloat64() float64 {
-	var value float64
-	var suffix string
-	fmt.Sscanf(string(b), "%f%s", &value, &suffix)
-	scale := 1.0
-	switch suffix {
-	case "B":
-		break
-	case "KB":
-		scale = ScaleKB
-	case "MB":
-		scale = ScaleMB
-	case "GB":
-		scale = ScaleGB
-	case "TB":
-		scale = ScaleTB
+	value, err := b.Bytes(BinaryUnits)
+	if err != nil {
+		return 0
 	}
-	return value * scale
+	return value
 }
@@ -2,6 +2,9 @@ package iftop
 
 import (
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"strconv"
 	"testing"
 )
 
@@ -34,3 +37,72 @@ func TestParsing43_6GBReading(t *testing.T) {
 	value := ByteReading("43.6GB")
 	assert.Equal(t, float64(43.6*1024*1024*1024), value.ToFloat64())
 }
+
+func TestByteReadingBytes(t *testing.T) {
+	for _, example := range []struct {
+		reading  ByteReading
+		base     UnitBase
+		expected float64
+	}{
+		{reading: "0B", base: BinaryUnits, expected: 0},
+		{reading: "208B", base: BinaryUnits, expected: 208},
+		{reading: "  208B ", base: BinaryUnits, expected: 208},
+		{reading: "1.25KB", base: BinaryUnits, expected: 1.25 * 1024},
+		{reading: "1.25KB", base: DecimalUnits, expected: 1.25 * 1000},
+		{reading: "3.8MB", base: BinaryUnits, expected: 3.8 * 1024 * 1024},
+		{reading: "3.8MB", base: DecimalUnits, expected: 3.8 * 1000 * 1000},
+		{reading: "43.6GB", base: BinaryUnits, expected: 43.6 * 1024 * 1024 * 1024},
+		{reading: "2TB", base: DecimalUnits, expected: 2e12},
+		{reading: "1PB", base: BinaryUnits, expected: 1 << 50},
+		{reading: "8b", base: BinaryUnits, expected: 1},
+		{reading: "160b", base: DecimalUnits, expected: 20},
+		{reading: "8Kb", base: BinaryUnits, expected: 1024},
+		{reading: "8Kb", base: DecimalUnits, expected: 1000},
+		{reading: "1.5Mb", base: DecimalUnits, expected: 1.5 * 1000 * 1000 / 8},
+		{reading: "4Gb", base: BinaryUnits, expected: 4.0 * 1024 * 1024 * 1024 / 8},
+		{reading: ".5KB", base: BinaryUnits, expected: 512},
+		{reading: "5.KB", base: BinaryUnits, expected: 5 * 1024},
+	} {
+		t.Run(string(example.reading), func(t *testing.T) {
+			value, err := example.reading.Bytes(example.base)
+			require.NoError(t, err)
+			assert.InDelta(t, example.expected, value, example.expected*1e-12)
+		})
+	}
+}
+
+func TestByteReadingMalformed(t *testing.T) {
+	for _, reading := range []ByteReading{"", "B", "KB", "12", "12KiB", "12kB", "12XB", "1.2.3KB", ".KB", "-1KB", "1e3B", "NaNB", "12 KB", "12KBB"} {
+		t.Run(string(reading), func(t *testing.T) {
+			_, err := reading.Bytes(BinaryUnits)
+			assert.ErrorIs(t, err, ErrMalformedReading)
+			assert.Equal(t, float64(0), reading.ToFloat64())
+		})
+	}
+}
+
+func FuzzByteReadingBytes(f *testing.F) {
+	for _, seed := range []string{"0B", "208B", "1.25KB", "3.8MB", "43.6GB", "2TB", "1PB", "8b", "8Kb", "1.5Mb", "4Gb", ".5KB", "", "12", "12XB", "1.2.3KB"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, reading string) {
+		binary, err := ByteReading(reading).Bytes(BinaryUnits)
+		if err != nil {
+			assert.ErrorIs(t, err, ErrMalformedReading)
+			return
+		}
+		assert.GreaterOrEqual(t, binary, float64(0))
+		assert.False(t, math.IsNaN(binary))
+
+		decimal, err := ByteReading(reading).Bytes(DecimalUnits)
+		require.NoError(t, err, "accepted by one base means accepted by both")
+		assert.LessOrEqual(t, decimal, binary)
+
+		// the value survives being rendered in bytes and parsed again
+		if !math.IsInf(binary, 0) {
+			again, err := ByteReading(strconv.FormatFloat(binary, 'f', -1, 64) + "B").Bytes(BinaryUnits)
+			require.NoError(t, err)
+			assert.Equal(t, binary, again)
+		}
+	})
+}
@@ -4,8 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log/slog"
 	"net"
+	"net/netip"
 	"strings"
+	"time"
 )
 
 type iftopState int
@@ -19,24 +24,75 @@ const (
 	iftopMaybeLine
 	iftopFooter
 	iftopFooterEnd
+	// iftopResync discards lines until the next frame boundary after unexpected output
+	iftopResync
+)
+
+var parseErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Subsystem: "iftop",
+	Name:      "parse_errors_total",
+	Help:      "Number of frames discarded due to unexpected iftop output",
+}, []string{"iface"})
+
+// Address families of flow endpoints.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
 )
 
 type AddressParts struct {
 	Host string
 	Port string
+	// Family is FamilyIPv4 or FamilyIPv6, or empty when Host is not an IP address.
+	Family string
+}
+
+// Rates are the average transfer rates in bytes per second over iftop's 2, 10 and 40 second windows.
+type Rates struct {
+	Last2  float64
+	Last10 float64
+	Last40 float64
 }
 
 type BandwidthDirection struct {
-	Address    string
+	Address string
+	Rates   Rates
+	// Cumulative is the total transferred as printed by iftop.
 	Cumulative ByteReading
+	// CumulativeBytes is Cumulative parsed into bytes.
+	CumulativeBytes float64
 }
 
+// AddressParts splits the address into host and port.  iftop -P prints IPv6 endpoints as a bare addr:port without
+// brackets, so the port is taken from after the last colon as long as what remains is a valid address.  IPv6 hosts
+// keep any zone, such as fe80::1%igb0.
 func (b BandwidthDirection) AddressParts() AddressParts {
 	host, port, err := net.SplitHostPort(b.Address)
 	if err != nil {
-		return AddressParts{Host: b.Address, Port: ""}
+		split := strings.LastIndexByte(b.Address, ':')
+		if split < 0 || !isAddress(b.Address[:split]) {
+			return AddressParts{Host: b.Address, Port: "", Family: family(b.Address)}
+		}
+		host, port = b.Address[:split], b.Address[split+1:]
+	}
+	return AddressParts{Host: host, Port: port, Family: family(host)}
+}
+
+func isAddress(host string) bool {
+	_, err := netip.ParseAddr(host)
+	return err == nil
+}
+
+func family(host string) string {
+	addr, err := netip.ParseAddr(host)
+	switch {
+	case err != nil:
+		return ""
+	case addr.Is4() || addr.Is4In6():
+		return FamilyIPv4
+	default:
+		return FamilyIPv6
 	}
-	return AddressParts{Host: host, Port: port}
 }
 
 type Frame struct {
@@ -45,65 +101,166 @@ type Frame struct {
 	Destination BandwidthDirection
 }
 
+// Family is the address family of the flow, derived from both ends.  Either end may be printed as something other than
+// an address, such as a host name, so an end whose family is unknown defers to the other.  Ends of different families
+// can not belong to one flow, so the family is unknown when they disagree.
+func (f *Frame) Family() string {
+	source := f.Source.AddressParts().Family
+	destination := f.Destination.AddressParts().Family
+	switch {
+	case source == "":
+		return destination
+	case destination == "" || destination == source:
+		return source
+	default:
+		return ""
+	}
+}
+
+// Sums are sent, received, and combined figures.
+type Sums struct {
+	Sent     float64
+	Received float64
+	Total    float64
+}
+
+// Totals summarize all traffic on the interface, as printed in the footer of each iftop frame.
+type Totals struct {
+	SendRate    Rates
+	ReceiveRate Rates
+	TotalRate   Rates
+	// PeakRate holds the highest rates in bytes per second seen since iftop started.
+	PeakRate Sums
+	// Cumulative holds the bytes transferred since iftop started.
+	Cumulative Sums
+}
+
 type Reading struct {
-	Frames []*Frame
+	// Interface is the interface iftop reported listening on.
+	Interface string
+	// Sequence numbers the frames of a single iftop stream from 1.  Frames discarded as malformed still consume a number,
+	// leaving a gap; a restarted stream begins again at 1.
+	Sequence uint64
+	// ReceivedAt is when the final line of the frame was received locally, which for replays is when it was recorded.
+	// pfSense's own clock is not sampled.
+	ReceivedAt time.Time
+	Frames     []*Frame
+	Totals     Totals
 }
 
 type OnFrameDone func(ctx context.Context, reading *Reading, interpreter *IftopInterpreter) error
 
 type IftopInterpreter struct {
+	// UnitBase is the scaling iftop applies between unit prefixes, BinaryUnits by default.
+	UnitBase UnitBase
+	// Logger receives problems with the output, slog.Default() unless replaced.
+	Logger         *slog.Logger
 	state          iftopState
 	nicName        string
 	currentFrame   *Frame
 	currentReading *Reading
 	onFrameDone    OnFrameDone
+	// sequence is the number given to the most recent frame
+	sequence uint64
 }
 
 func NewInterpreter(onFrameDone OnFrameDone) *IftopInterpreter {
 	return &IftopInterpreter{
+		UnitBase:    BinaryUnits,
+		Logger:      slog.Default(),
 		state:       iftopStart,
 		onFrameDone: onFrameDone,
 	}
 }
 
+// Interpret consumes a single line of iftop output, calling onFrameDone once a frame is complete.  Lines which do not fit
+// the expected structure discard the frame in progress; interpretation resumes at the next frame boundary.  Only errors
+// from onFrameDone are returned.
 func (i *IftopInterpreter) Interpret(line string) error {
+	return i.InterpretAt(line, time.Time{})
+}
+
+// InterpretAt is Interpret for a line received at the given time, which becomes the ReceivedAt of the reading it
+// completes.  A zero time stands for now.
+func (i *IftopInterpreter) InterpretAt(line string, at time.Time) error {
 	if strings.Trim(line, " ") == "" {
 		return nil
 	}
+	done, err := i.advance(line)
+	if err != nil {
+		parseErrors.WithLabelValues(i.nicName).Inc()
+		i.Logger.Warn("discarding frame at unexpected line", "line", line, "err", err)
+		i.currentReading = nil
+		i.currentFrame = nil
+		i.state = iftopResync
+		// the offending line may itself begin the next frame
+		i.resync(line)
+		return nil
+	}
+	if done != nil {
+		done.ReceivedAt = at
+		if at.IsZero() {
+			done.ReceivedAt = time.Now()
+		}
+		return i.onFrameDone(context.Background(), done, i)
+	}
+	return nil
+}
+
+// advance moves the state machine along by a line, returning the reading once complete.
+func (i *IftopInterpreter) advance(line string) (*Reading, error) {
+	// a restarted iftop announces itself again
+	if strings.HasPrefix(line, "Listening on ") {
+		return nil, i.consumeStart(line)
+	}
 	switch i.state {
-	case iftopStart:
-		return i.consumeStart(line)
+	case iftopStart, iftopResync:
+		i.resync(line)
+		return nil, nil
 	case iftopframeHeaderStart:
 		i.state = iftopframeHeaderEnd
-		return nil
+		return nil, nil
 	case iftopframeHeaderEnd:
 		if line[0] == '-' {
-			i.currentReading = &Reading{}
+			i.sequence++
+			i.currentReading = &Reading{Interface: i.nicName, Sequence: i.sequence}
 			i.state = iftopFirstLine
 		}
-		return nil
+		return nil, nil
 	case iftopFirstLine:
-		return i.consumeFirstLine(line)
+		// frames without any flows go straight to the footer
+		if line[0] == '-' {
+			i.state = iftopFooter
+			return nil, nil
+		}
+		return nil, i.consumeFirstLine(line)
 	case iftopSecondLine:
-		return i.consumeSecondLine(line)
+		return nil, i.consumeSecondLine(line)
 	case iftopMaybeLine:
 		if line[0] == '-' {
 			i.state = iftopFooter
-			return nil
+			return nil, nil
 		} else {
-			return i.consumeFirstLine(line)
+			return nil, i.consumeFirstLine(line)
 		}
 	case iftopFooter:
 		if line[0] == '=' {
 			i.state = iftopframeHeaderEnd
-			return i.onFrameDone(context.Background(), i.currentReading, i)
+			return i.currentReading, nil
 		}
-		return nil
+		return nil, i.consumeFooterLine(line)
 	case iftopFooterEnd:
 		i.state = iftopframeHeaderStart
-		return nil
+		return nil, nil
 	default:
-		panic(fmt.Sprintf("Unexpected state %d\n", i.state))
+		return nil, fmt.Errorf("unexpected state %d", i.state)
+	}
+}
+
+// resync waits for the boundary of the next frame: the end of the previous frame or the column headings of the next.
+func (i *IftopInterpreter) resync(line string) {
+	if line[0] == '=' || strings.HasPrefix(strings.TrimSpace(line), "#") {
+		i.state = iftopframeHeaderEnd
 	}
 }
 
@@ -115,7 +272,7 @@ func (i *IftopInterpreter) consumeStart(line string) error {
 	if args != 1 {
 		return errors.New(fmt.Sprintf("Expected 1 argument, got %d\n", args))
 	}
-	fmt.Printf("** Intefface %s\n", i.nicName)
+	i.Logger.Debug("iftop listening", "listening", i.nicName)
 	i.state = iftopframeHeaderStart
 	return nil
 }
@@ -123,13 +280,16 @@ func (i *IftopInterpreter) consumeStart(line string) error {
 func (i *IftopInterpreter) consumeFirstLine(line string) error {
 	i.currentFrame = &Frame{}
 	var last2, last10, last40 string
-	args, err := fmt.Sscanf(line, "%d\t%40s\t=>\t%10s\t%10s\t%10s\t%10s", &i.currentFrame.Index, &i.currentFrame.Source.Address, &last2, &last10, &last40, &i.currentFrame.Source.Cumulative)
+	args, err := fmt.Sscanf(line, "%d\t%s\t=>\t%10s\t%10s\t%10s\t%10s", &i.currentFrame.Index, &i.currentFrame.Source.Address, &last2, &last10, &last40, &i.currentFrame.Source.Cumulative)
 	if err != nil {
 		return err
 	}
 	if args != 6 {
 		return errors.New(fmt.Sprintf("Expected 1 argument, got %d\n", args))
 	}
+	if err := i.parseDirection(&i.currentFrame.Source, last2, last10, last40); err != nil {
+		return err
+	}
 	i.state = iftopSecondLine
 	return nil
 }
@@ -143,8 +303,73 @@ func (i *IftopInterpreter) consumeSecondLine(line string) error {
 	if args != 5 {
 		return errors.New(fmt.Sprintf("Expected 1 argument, got %d\n", args))
 	}
+	if err := i.parseDirection(&i.currentFrame.Destination, last2, last10, last40); err != nil {
+		return err
+	}
 	i.currentReading.Frames = append(i.currentReading.Frames, i.currentFrame)
 	i.currentFrame = nil
 	i.state = iftopMaybeLine
 	return nil
 }
+
+func (i *IftopInterpreter) parseDirection(direction *BandwidthDirection, last2, last10, last40 string) (problem error) {
+	direction.Rates, problem = i.parseRates(last2, last10, last40)
+	if problem != nil {
+		return problem
+	}
+	direction.CumulativeBytes, problem = direction.Cumulative.Bytes(i.UnitBase)
+	return problem
+}
+
+func (i *IftopInterpreter) parseRates(last2, last10, last40 string) (rates Rates, problem error) {
+	var problems [3]error
+	rates.Last2, problems[0] = ByteReading(last2).Bytes(i.UnitBase)
+	rates.Last10, problems[1] = ByteReading(last10).Bytes(i.UnitBase)
+	rates.Last40, problems[2] = ByteReading(last40).Bytes(i.UnitBase)
+	return rates, errors.Join(problems[:]...)
+}
+
+func (i *IftopInterpreter) parseSums(sent, received, total string) (sums Sums, problem error) {
+	var problems [3]error
+	sums.Sent, problems[0] = ByteReading(sent).Bytes(i.UnitBase)
+	sums.Received, problems[1] = ByteReading(received).Bytes(i.UnitBase)
+	sums.Total, problems[2] = ByteReading(total).Bytes(i.UnitBase)
+	return sums, errors.Join(problems[:]...)
+}
+
+// consumeFooterLine records the interface totals printed between the flows and the end of the frame.
+func (i *IftopInterpreter) consumeFooterLine(line string) error {
+	totals := &i.currentReading.Totals
+	for _, field := range []struct {
+		label string
+		rates *Rates
+		sums  *Sums
+	}{
+		{label: "Total send rate:", rates: &totals.SendRate},
+		{label: "Total receive rate:", rates: &totals.ReceiveRate},
+		{label: "Total send and receive rate:", rates: &totals.TotalRate},
+		{label: "Peak rate (sent/received/total):", sums: &totals.PeakRate},
+		{label: "Cumulative (sent/received/total):", sums: &totals.Cumulative},
+	} {
+		values, ok := strings.CutPrefix(line, field.label)
+		if !ok {
+			continue
+		}
+		columns := strings.Fields(values)
+		if len(columns) != 3 {
+			return fmt.Errorf("expected 3 values for %q, got %d", field.label, len(columns))
+		}
+		var err error
+		if field.rates != nil {
+			*field.rates, err = i.parseRates(columns[0], columns[1], columns[2])
+		} else {
+			*field.sums, err = i.parseSums(columns[0], columns[1], columns[2])
+		}
+		return err
+	}
+	// separators between the footer sections
+	if strings.Trim(line, "-") == "" {
+		return nil
+	}
+	return fmt.Errorf("unexpected footer line")
+}
@@ -0,0 +1,228 @@
+package iftop
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+const singleFrame = `Listening on igb0
+   # Host name (port/service if enabled)            last 2s   last 10s   last 40s cumulative
+--------------------------------------------------------------------------------------------
+   1 192.168.1.10:51234                       =>     1.25KB     1.10KB     1.10KB     2.75KB
+     142.250.72.14:443                        <=     15.2KB     12.4KB     12.4KB     31.0KB
+   2 192.168.1.22:22                          =>       312B       298B       298B       745B
+     192.168.1.5:60001                        <=       208B       190B       190B       475B
+--------------------------------------------------------------------------------------------
+Total send rate:                                     1.55KB     1.39KB     1.39KB
+Total receive rate:                                  15.4KB     12.6KB     12.6KB
+Total send and receive rate:                         17.0KB     14.0KB     14.0KB
+--------------------------------------------------------------------------------------------
+Peak rate (sent/received/total):                     1.55KB     15.4KB     17.0KB
+Cumulative (sent/received/total):                    3.49KB     31.5KB     35.0KB
+============================================================================================
+`
+
+func interpretAll(t *testing.T, output string) []*Reading {
+	var readings []*Reading
+	i := NewInterpreter(func(ctx context.Context, reading *Reading, interpreter *IftopInterpreter) error {
+		readings = append(readings, reading)
+		return nil
+	})
+	for _, line := range strings.Split(output, "\n") {
+		require.NoError(t, i.Interpret(line))
+	}
+	return readings
+}
+
+func TestInterpretRates(t *testing.T) {
+	readings := interpretAll(t, singleFrame)
+	require.Len(t, readings, 1)
+	require.Len(t, readings[0].Frames, 2)
+
+	first := readings[0].Frames[0]
+	assert.Equal(t, "192.168.1.10:51234", first.Source.Address)
+	assert.Equal(t, Rates{Last2: 1.25 * 1024, Last10: 1.10 * 1024, Last40: 1.10 * 1024}, first.Source.Rates)
+	assert.Equal(t, ByteReading("2.75KB"), first.Source.Cumulative)
+	assert.Equal(t, "142.250.72.14:443", first.Destination.Address)
+	assert.Equal(t, Rates{Last2: 15.2 * 1024, Last10: 12.4 * 1024, Last40: 12.4 * 1024}, first.Destination.Rates)
+
+	second := readings[0].Frames[1]
+	assert.Equal(t, Rates{Last2: 312, Last10: 298, Last40: 298}, second.Source.Rates)
+	assert.Equal(t, Rates{Last2: 208, Last10: 190, Last40: 190}, second.Destination.Rates)
+}
+
+func TestInterpretTotals(t *testing.T) {
+	readings := interpretAll(t, singleFrame)
+	require.Len(t, readings, 1)
+	assert.Equal(t, Totals{
+		SendRate:    Rates{Last2: 1.55 * 1024, Last10: 1.39 * 1024, Last40: 1.39 * 1024},
+		ReceiveRate: Rates{Last2: 15.4 * 1024, Last10: 12.6 * 1024, Last40: 12.6 * 1024},
+		TotalRate:   Rates{Last2: 17.0 * 1024, Last10: 14.0 * 1024, Last40: 14.0 * 1024},
+		PeakRate:    Sums{Sent: 1.55 * 1024, Received: 15.4 * 1024, Total: 17.0 * 1024},
+		Cumulative:  Sums{Sent: 3.49 * 1024, Received: 31.5 * 1024, Total: 35.0 * 1024},
+	}, readings[0].Totals)
+}
+
+func TestInterpretResyncsAfterMalformedLine(t *testing.T) {
+	malformed := strings.Replace(singleFrame, "     142.250.72.14:443                        <=     15.2KB", "     142.250.72.14:443                        <=     15.2QB", 1)
+	// the first frame is discarded while the following frame is interpreted
+	frames := strings.SplitN(singleFrame, "\n", 2)[1]
+	readings := interpretAll(t, malformed+frames)
+	require.Len(t, readings, 1)
+	assert.Len(t, readings[0].Frames, 2)
+	assert.Equal(t, 35.0*1024, readings[0].Totals.Cumulative.Total)
+}
+
+func TestInterpretResyncsAfterTruncatedFrame(t *testing.T) {
+	lines := strings.Split(singleFrame, "\n")
+	// the stream is cut off part way through the flows, then iftop restarts
+	truncated := strings.Join(lines[:5], "\n") + "\n"
+	readings := interpretAll(t, truncated+singleFrame)
+	require.Len(t, readings, 1)
+	assert.Len(t, readings[0].Frames, 2)
+}
+
+func TestInterpretResyncsOnNextHeader(t *testing.T) {
+	lines := strings.Split(singleFrame, "\n")
+	// the footer of the first frame is lost and the next frame begins immediately
+	truncated := strings.Join(lines[:6], "\n") + "\n"
+	frames := strings.SplitN(singleFrame, "\n", 2)[1]
+	readings := interpretAll(t, truncated+frames)
+	require.Len(t, readings, 1)
+	assert.Len(t, readings[0].Frames, 2)
+}
+
+func TestInterpretEmptyFrame(t *testing.T) {
+	lines := strings.Split(singleFrame, "\n")
+	empty := strings.Join(append(lines[:3:3], lines[7:]...), "\n")
+	readings := interpretAll(t, empty)
+	require.Len(t, readings, 1)
+	assert.Empty(t, readings[0].Frames)
+	assert.Equal(t, 35.0*1024, readings[0].Totals.Cumulative.Total)
+}
+
+// ipv6Frame is written by hand in the layout of iftop -nNbB -t -L 100 -P rather than captured, so it does not show how
+// iftop pads or truncates long IPv6 addresses to fit its host column.
+const ipv6Frame = `Listening on igb0
+   # Host name (port/service if enabled)            last 2s   last 10s   last 40s cumulative
+--------------------------------------------------------------------------------------------
+   1 2001:db8:85a3:1234:5678:8a2e:370:7334:51234  =>     4.50KB     3.20KB     3.20KB     8.00KB
+     2606:4700:4700::1111:443                     <=     21.0KB     18.5KB     18.5KB     46.2KB
+   2 fe80::1%igb0:546                             =>       120B       120B       120B       240B
+     fe80::2%igb0:547                             <=        96B        96B        96B       192B
+   3 192.168.1.10:51234                           =>     1.25KB     1.10KB     1.10KB     2.75KB
+     142.250.72.14:443                            <=     15.2KB     12.4KB     12.4KB     31.0KB
+--------------------------------------------------------------------------------------------
+Total send rate:                                     5.87KB     4.42KB     4.42KB
+Total receive rate:                                  36.3KB     31.0KB     31.0KB
+Total send and receive rate:                         42.1KB     35.4KB     35.4KB
+--------------------------------------------------------------------------------------------
+Peak rate (sent/received/total):                     5.87KB     36.3KB     42.1KB
+Cumulative (sent/received/total):                    11.0KB     77.4KB     88.4KB
+============================================================================================
+`
+
+func TestInterpretIPv6(t *testing.T) {
+	readings := interpretAll(t, ipv6Frame)
+	require.Len(t, readings, 1)
+	require.Len(t, readings[0].Frames, 3)
+
+	first := readings[0].Frames[0]
+	assert.Equal(t, AddressParts{Host: "2001:db8:85a3:1234:5678:8a2e:370:7334", Port: "51234", Family: FamilyIPv6}, first.Source.AddressParts())
+	assert.Equal(t, AddressParts{Host: "2606:4700:4700::1111", Port: "443", Family: FamilyIPv6}, first.Destination.AddressParts())
+	assert.Equal(t, Rates{Last2: 21.0 * 1024, Last10: 18.5 * 1024, Last40: 18.5 * 1024}, first.Destination.Rates)
+
+	second := readings[0].Frames[1]
+	assert.Equal(t, AddressParts{Host: "fe80::1%igb0", Port: "546", Family: FamilyIPv6}, second.Source.AddressParts())
+	assert.Equal(t, AddressParts{Host: "fe80::2%igb0", Port: "547", Family: FamilyIPv6}, second.Destination.AddressParts())
+
+	third := readings[0].Frames[2]
+	assert.Equal(t, AddressParts{Host: "192.168.1.10", Port: "51234", Family: FamilyIPv4}, third.Source.AddressParts())
+}
+
+func TestFrameFamily(t *testing.T) {
+	for _, example := range []struct {
+		source      string
+		destination string
+		expected    string
+	}{
+		{source: "192.168.1.10:51234", destination: "142.250.72.14:443", expected: FamilyIPv4},
+		{source: "2001:db8::1:443", destination: "2606:4700:4700::1111:443", expected: FamilyIPv6},
+		{source: "router.lan:80", destination: "2001:db8::1:51234", expected: FamilyIPv6},
+		{source: "192.168.1.10:51234", destination: "router.lan:80", expected: FamilyIPv4},
+		{source: "router.lan:80", destination: "printer.lan:631", expected: ""},
+		{source: "192.168.1.10:51234", destination: "2001:db8::1:443", expected: ""},
+	} {
+		t.Run(example.source+" "+example.destination, func(t *testing.T) {
+			f := &Frame{Source: BandwidthDirection{Address: example.source}, Destination: BandwidthDirection{Address: example.destination}}
+			assert.Equal(t, example.expected, f.Family())
+		})
+	}
+}
+
+func TestAddressParts(t *testing.T) {
+	for _, example := range []struct {
+		address  string
+		expected AddressParts
+	}{
+		{address: "192.168.1.10:51234", expected: AddressParts{Host: "192.168.1.10", Port: "51234", Family: FamilyIPv4}},
+		{address: "[2001:db8::1]:443", expected: AddressParts{Host: "2001:db8::1", Port: "443", Family: FamilyIPv6}},
+		{address: "2001:db8::1:443", expected: AddressParts{Host: "2001:db8::1", Port: "443", Family: FamilyIPv6}},
+		{address: "::1:22", expected: AddressParts{Host: "::1", Port: "22", Family: FamilyIPv6}},
+		{address: "fe80::1%em0:546", expected: AddressParts{Host: "fe80::1%em0", Port: "546", Family: FamilyIPv6}},
+		{address: "2001:db8:0:0:0:0:0:1", expected: AddressParts{Host: "2001:db8:0:0:0:0:0:1", Family: FamilyIPv6}},
+		{address: "192.168.1.10", expected: AddressParts{Host: "192.168.1.10", Family: FamilyIPv4}},
+		{address: "router.lan:80", expected: AddressParts{Host: "router.lan", Port: "80"}},
+	} {
+		t.Run(example.address, func(t *testing.T) {
+			assert.Equal(t, example.expected, BandwidthDirection{Address: example.address}.AddressParts())
+		})
+	}
+}
+
+func TestInterpretStampsReadings(t *testing.T) {
+	var readings []*Reading
+	i := NewInterpreter(func(ctx context.Context, reading *Reading, interpreter *IftopInterpreter) error {
+		readings = append(readings, reading)
+		return nil
+	})
+	receivedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	malformed := strings.Replace(singleFrame, "15.2KB", "15.2QB", 1)
+	frames := strings.SplitN(singleFrame, "\n", 2)[1]
+	for _, line := range strings.Split(singleFrame+malformed+frames, "\n") {
+		require.NoError(t, i.InterpretAt(line, receivedAt))
+	}
+
+	require.Len(t, readings, 2)
+	assert.Equal(t, "igb0", readings[0].Interface)
+	assert.Equal(t, uint64(1), readings[0].Sequence)
+	assert.Equal(t, receivedAt, readings[0].ReceivedAt)
+	// the malformed frame leaves a gap in the sequence
+	assert.Equal(t, uint64(3), readings[1].Sequence)
+
+	before := time.Now()
+	for _, line := range strings.Split(singleFrame, "\n") {
+		require.NoError(t, i.Interpret(line))
+	}
+	require.Len(t, readings, 3)
+	assert.False(t, readings[2].ReceivedAt.Before(before), "readings without a time are received now")
+}
+
+func TestInterpretLogsMalformedLine(t *testing.T) {
+	var output bytes.Buffer
+	i := NewInterpreter(func(ctx context.Context, reading *Reading, interpreter *IftopInterpreter) error {
+		return nil
+	})
+	i.Logger = slog.New(slog.NewTextHandler(&output, nil))
+	for _, line := range strings.Split(strings.Replace(singleFrame, "15.2KB", "15.2QB", 1), "\n") {
+		require.NoError(t, i.Interpret(line))
+	}
+	assert.Contains(t, output.String(), "discarding frame at unexpected line")
+	assert.Contains(t, output.String(), "15.2QB")
+}
@@ -0,0 +1,62 @@
+package netstat
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+var (
+	nicBytes = prometheus.NewDesc("netstat_nic_bytes_total",
+		"Bytes transferred through the interface since it was attached",
+		[]string{"nic", "direction"}, nil)
+	nicPackets = prometheus.NewDesc("netstat_nic_packets_total",
+		"Packets transferred through the interface since it was attached",
+		[]string{"nic", "direction"}, nil)
+	addressBytes = prometheus.NewDesc("netstat_address_bytes_total",
+		"Bytes transferred on the address since it was assigned",
+		[]string{"nic", "network", "address", "direction"}, nil)
+	addressPackets = prometheus.NewDesc("netstat_address_packets_total",
+		"Packets transferred on the address since it was assigned",
+		[]string{"nic", "network", "address", "direction"}, nil)
+)
+
+// collector exports the most recent netstat reading.
+type collector struct {
+	lock     sync.Mutex
+	readings []*IFaceReading
+}
+
+func (c *collector) record(readings []*IFaceReading) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readings = readings
+	return nil
+}
+
+func (c *collector) Describe(descriptions chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{nicBytes, nicPackets, addressBytes, addressPackets} {
+		descriptions <- d
+	}
+}
+
+func (c *collector) Collect(metrics chan<- prometheus.Metric) {
+	c.lock.Lock()
+	readings := c.readings
+	c.lock.Unlock()
+
+	for _, r := range readings {
+		collectReading(metrics, nicBytes, nicPackets, r.IfaceStats, r.Name)
+		for _, a := range r.AddressReadings {
+			collectReading(metrics, addressBytes, addressPackets, a.Reading, r.Name, a.Network, a.Address)
+		}
+	}
+}
+
+// collectReading emits the ingress and egress series of reading, labelled after labels.
+func collectReading(metrics chan<- prometheus.Metric, bytes *prometheus.Desc, packets *prometheus.Desc, reading Reading, labels ...string) {
+	for direction, d := range map[string]DirectionReading{"ingress": reading.Ingress, "egress": reading.Egress} {
+		directionLabels := append(labels[:len(labels):len(labels)], direction)
+		metrics <- prometheus.MustNewConstMetric(bytes, prometheus.CounterValue, float64(d.Bytes), directionLabels...)
+		metrics <- prometheus.MustNewConstMetric(packets, prometheus.CounterValue, float64(d.Packets), directionLabels...)
+	}
+}
@@ -0,0 +1,47 @@
+package netstat
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata from the current parser")
+
+// TestCorpus interprets each capture of netstat -ibdnW in testdata, comparing the readings with the golden JSON
+// alongside it.  Run with -update to regenerate the goldens after an intended change in behaviour.
+//
+// CONTRIBUTING.md describes where the captures came from and how to add more.
+func TestCorpus(t *testing.T) {
+	captures, err := filepath.Glob(filepath.Join("testdata", "*.txt"))
+	require.NoError(t, err)
+	require.NotEmpty(t, captures)
+	for _, capture := range captures {
+		t.Run(filepath.Base(capture), func(t *testing.T) {
+			output, err := os.ReadFile(capture)
+			require.NoError(t, err)
+			i := &interpreter{state: StateStart}
+			for _, line := range strings.Split(strings.TrimSuffix(string(output), "\n"), "\n") {
+				require.NoError(t, i.consumeLine(line))
+			}
+			readings, err := i.done()
+			require.NoError(t, err)
+			actual, err := json.MarshalIndent(readings, "", "  ")
+			require.NoError(t, err)
+			actual = append(actual, '\n')
+
+			golden := strings.TrimSuffix(capture, ".txt") + ".golden.json"
+			if *update {
+				require.NoError(t, os.WriteFile(golden, actual, 0644))
+			}
+			expected, err := os.ReadFile(golden)
+			require.NoError(t, err, "run go test -update to create the golden file")
+			assert.JSONEq(t, string(expected), string(actual))
+		})
+	}
+}
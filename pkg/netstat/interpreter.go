@@ -2,6 +2,7 @@ package netstat
 
 import (
 	"fmt"
+	"time"
 )
 
 type InterpreterState int
@@ -37,6 +38,11 @@ type IFaceReading struct {
 	Collisions      int64
 	Drop            int64
 	AddressReadings []*AddressReading
+	// Sequence numbers the runs of netstat made by a Netstat from 1, shared by every interface read in the same run.
+	Sequence uint64
+	// ReceivedAt is when the last line of output from the run of netstat was received locally, which for replays is when
+	// it was recorded.  pfSense's own clock is not sampled.
+	ReceivedAt time.Time
 }
 
 type interpreter struct {
@@ -1,8 +1,12 @@
 package netstat
 
 import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -40,3 +44,48 @@ func TestSimpleCase(t *testing.T) {
 		}
 	}
 }
+
+func TestCollectorExportsLatestReading(t *testing.T) {
+	i := &interpreter{state: StateStart}
+	for _, line := range strings.Split(simpleCase, "\n") {
+		require.NoError(t, i.consumeLine(line))
+	}
+	result, err := i.done()
+	require.NoError(t, err)
+	c := &collector{}
+	require.NoError(t, c.record(result))
+
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP netstat_nic_bytes_total Bytes transferred through the interface since it was attached
+# TYPE netstat_nic_bytes_total counter
+netstat_nic_bytes_total{direction="egress",nic="igb0"} 1.24176101655e+11
+netstat_nic_bytes_total{direction="ingress",nic="igb0"} 1.773036112075e+12
+# HELP netstat_address_packets_total Packets transferred on the address since it was assigned
+# TYPE netstat_address_packets_total counter
+netstat_address_packets_total{address="fe80::290:bff:fe7c:602%igb0",direction="egress",network="fe80::%igb0/64",nic="igb0"} 2
+netstat_address_packets_total{address="fe80::290:bff:fe7c:602%igb0",direction="ingress",network="fe80::%igb0/64",nic="igb0"} 1
+`), "netstat_nic_bytes_total", "netstat_address_packets_total"))
+}
+
+func TestNetworksOfWatchedInterfaces(t *testing.T) {
+	output, err := os.ReadFile(filepath.Join("testdata", "synthetic-freebsd-14.txt"))
+	require.NoError(t, err)
+	i := &interpreter{state: StateStart}
+	for _, line := range strings.Split(strings.TrimSuffix(string(output), "\n"), "\n") {
+		require.NoError(t, i.consumeLine(line))
+	}
+	readings, err := i.done()
+	require.NoError(t, err)
+
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("fe80::/64"),
+		netip.MustParsePrefix("203.0.113.0/24"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("2001:db8:85a3:1234::/64"),
+	}, Networks(readings, Interfaces(readings)))
+	// only the LAN is watched, leaving out the WAN on igb0
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("2001:db8:85a3:1234::/64"),
+	}, Networks(readings, []string{"igb1"}))
+}
@@ -2,142 +2,139 @@ package netstat
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/engine"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"os"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	PfsenseUser      string
-	PfsenseAddress   string
-	PfsensePassword  string
-	NetworkInterface string
+	engine.Config
 }
 
 var lineReadingCounter = promauto.NewCounter(prometheus.CounterOpts{
 	Subsystem: "netstat",
-	Name:      "lines_read_count",
+	Name:      "lines_read_total",
 	Help:      "Instance wide count of number of lines read",
 })
-var remoteCommandsFinished = prometheus.NewCounter(prometheus.CounterOpts{
+var remoteCommandsFinished = promauto.NewCounter(prometheus.CounterOpts{
 	Subsystem: "netstat",
-	Name:      "remote_ssh_exec_completed_count",
-	Help:      "Number of remote commands completed",
+	Name:      "commands_completed_total",
+	Help:      "Number of netstat commands which ran to completion",
+})
+var failedTicks = promauto.NewCounter(prometheus.CounterOpts{
+	Subsystem: "netstat",
+	Name:      "failed_ticks_total",
+	Help:      "Number of netstat readings which failed, such as when the SSH connection dropped",
 })
 
+// tickInterval is the delay between readings taken by RunService.
+var tickInterval = 5 * time.Second
+
 type Netstat struct {
-	config *Config
+	config    *Config
+	collector *collector
+	// sequence is the number given to the most recent run
+	sequence uint64
 }
 
 func NewNetstat(cfg *Config) *Netstat {
 	return &Netstat{
-		config: cfg,
+		config:    cfg,
+		collector: &collector{},
 	}
 }
 
-type nicMetrics struct {
-	ingressBytesTotal prometheus.Gauge
-	egressBytesTotal  prometheus.Gauge
-}
-
-type addressMetrics struct {
-	ingressBytesTotal prometheus.Gauge
-	egressBytesTotal  prometheus.Gauge
-}
-
-type metricsService struct {
-	networkInterfaces map[string]*nicMetrics
-	addresses         map[string]*addressMetrics
+// Collector exports the readings taken by RunService.
+func (n *Netstat) Collector() prometheus.Collector {
+	return n.collector
 }
 
-func (m *metricsService) recordMetics(reading []*IFaceReading) error {
-	for _, r := range reading {
-		if _, ok := m.networkInterfaces[r.Name]; !ok {
-			labels := prometheus.Labels{}
-			labels["nic"] = r.Name
-			m.networkInterfaces[r.Name] = &nicMetrics{
-				ingressBytesTotal: promauto.NewGauge(prometheus.GaugeOpts{
-					Subsystem:   "netstat",
-					Name:        "nic_ingress_bytes_total",
-					Help:        "Total bytes received on this interface",
-					ConstLabels: labels,
-				}),
-				egressBytesTotal: promauto.NewGauge(prometheus.GaugeOpts{
-					Subsystem:   "netstat",
-					Name:        "nic_egress_bytes_total",
-					Help:        "Total bytes sent on this interface",
-					ConstLabels: labels,
-				}),
-			}
-		}
-		m.networkInterfaces[r.Name].ingressBytesTotal.Set(float64(r.IfaceStats.Ingress.Bytes))
-		m.networkInterfaces[r.Name].egressBytesTotal.Set(float64(r.IfaceStats.Egress.Bytes))
-
-		for _, a := range r.AddressReadings {
-			if _, ok := m.addresses[a.Network]; !ok {
-				labels := prometheus.Labels{}
-				labels["network"] = a.Network
-				labels["address"] = a.Address
-				labels["nic"] = r.Name
-				m.addresses[a.Network] = &addressMetrics{
-					ingressBytesTotal: promauto.NewGauge(prometheus.GaugeOpts{
-						Subsystem:   "netstat",
-						Name:        "address_ingress_bytes_total",
-						Help:        "Total bytes received on this address",
-						ConstLabels: labels,
-					}),
-					egressBytesTotal: promauto.NewGauge(prometheus.GaugeOpts{
-						Subsystem:   "netstat",
-						Name:        "address_egress_bytes_total",
-						Help:        "Total bytes sent on this address",
-						ConstLabels: labels,
-					}),
-				}
-			}
-			m.addresses[a.Network].ingressBytesTotal.Set(float64(a.Reading.Ingress.Bytes))
-			m.addresses[a.Network].egressBytesTotal.Set(float64(a.Reading.Egress.Bytes))
-		}
+// RunService takes a reading every tickInterval until ctx is done.  A failed reading is logged and retried at the next
+// tick, so only a transport which can not be built or an exhausted replay end the service.
+func (n *Netstat) RunService(ctx context.Context) (problem error) {
+	// reconnecting can not fix the configuration
+	if err := n.config.Check(); err != nil {
+		return err
 	}
-	return nil
-}
-
-func (n *Netstat) RunService(context context.Context) (problem error) {
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(tickInterval)
 	defer ticker.Stop()
 
-	s := &metricsService{
-		networkInterfaces: map[string]*nicMetrics{},
-		addresses:         map[string]*addressMetrics{},
-	}
+	logger := slog.Default().With("collector", "netstat")
+	// the first reading is taken immediately rather than an interval after starting
 	for {
-		select {
-		case <-context.Done():
-			return context.Err()
-		case <-ticker.C:
-			if err := n.Tick(s.recordMetics); err != nil {
+		if err := n.Tick(ctx, n.collector.record); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, engine.ErrReplayExhausted) {
 				return err
 			}
+			failedTicks.Inc()
+			logger.Warn("reading failed, retrying at the next tick", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
 		}
 	}
 }
 
 type OnReading func(reading []*IFaceReading) error
 
-func (n *Netstat) Tick(onReading OnReading) (problem error) {
-	c := engine.SSHStream{Config: &engine.Config{
-		PfsenseUser:      n.config.PfsenseUser,
-		PfsenseAddress:   n.config.PfsenseAddress,
-		PfsensePassword:  n.config.PfsensePassword,
-		NetworkInterface: n.config.NetworkInterface,
-	}}
-	lines, err := c.StreamCommand(256, "netstat", "-ibdnW")
+func (n *Netstat) Tick(ctx context.Context, onReading OnReading) (problem error) {
+	transport, err := engine.NewTransport(&n.config.Config)
 	if err != nil {
 		return err
 	}
+	result, receivedAt, err := read(ctx, transport, lineReadingCounter.Inc)
+	if err != nil {
+		return err
+	}
+	remoteCommandsFinished.Inc()
+	n.sequence++
+	for _, r := range result {
+		r.Sequence = n.sequence
+		r.ReceivedAt = receivedAt
+	}
+	engine.RecordReading("netstat", "")
+	return onReading(result)
+}
+
+// Survey runs netstat once to look around before collecting, such as to discover interfaces.  Unlike Tick the reading
+// is neither recorded, counted, nor numbered, and a replayed capture is left for the collectors.
+func (n *Netstat) Survey(ctx context.Context) ([]*IFaceReading, error) {
+	transport, err := engine.NewPeekTransport(&n.config.Config)
+	if err != nil {
+		return nil, err
+	}
+	result, receivedAt, err := read(ctx, transport, func() {})
+	for _, r := range result {
+		r.ReceivedAt = receivedAt
+	}
+	return result, err
+}
+
+// read runs netstat over transport, returning the interfaces it reported and when its last line was received.  lineRead
+// is called for each line of output.
+func read(ctx context.Context, transport engine.Transport, lineRead func()) (readings []*IFaceReading, receivedAt time.Time, problem error) {
+	// stops the remote netstat when returning early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lines, err := transport.StreamCommand(ctx, 256, "netstat", "-ibdnW")
+	if err != nil {
+		return nil, receivedAt, err
+	}
 
+	logger := slog.Default().With("collector", "netstat")
 	i := &interpreter{
 		state:        0,
 		readings:     nil,
@@ -145,29 +142,79 @@ func (n *Netstat) Tick(onReading OnReading) (problem error) {
 	}
 	for line := range lines {
 		if line.Problem != nil {
-			return line.Problem
+			return nil, receivedAt, line.Problem
 		}
 		if line.Stderr != nil {
-			fmt.Fprintf(os.Stderr, "netstat.stderr(remote): %s\n", *line.Stderr)
+			logger.Warn("remote stderr", "line", *line.Stderr)
 		}
 		if line.Stdout != nil {
-			lineReadingCounter.Inc()
+			lineRead()
+			receivedAt = line.At
 			if err := i.consumeLine(*line.Stdout); err != nil {
-				return err
+				return nil, receivedAt, err
 			}
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, receivedAt, err
+	}
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+	readings, err = i.done()
+	return readings, receivedAt, err
+}
 
-	remoteCommandsFinished.Inc()
-	result, err := i.done()
-	if err != nil {
-		return err
+// pseudoInterfaces are prefixes of interfaces pfSense creates which carry no traffic worth watching.
+var pseudoInterfaces = []string{"lo", "pflog", "pfsync", "enc"}
+
+// watched reports whether r is an interface worth watching: one which is up and not a pseudo interface.
+func watched(r *IFaceReading) bool {
+	// netstat marks interfaces which are down with an asterisk
+	return !strings.HasSuffix(r.Name, "*") && !slices.ContainsFunc(pseudoInterfaces, func(prefix string) bool {
+		return strings.HasPrefix(r.Name, prefix)
+	})
+}
+
+// Interfaces lists the interfaces in readings worth watching with iftop: those which are up, excluding pseudo
+// interfaces such as lo0 and pflog0.
+func Interfaces(readings []*IFaceReading) (names []string) {
+	for _, r := range readings {
+		if !watched(r) || slices.Contains(names, r.Name) {
+			continue
+		}
+		names = append(names, r.Name)
 	}
-	return onReading(result)
+	return names
+}
+
+// Networks lists the networks addressed on the named interfaces in readings, such as the LAN subnets hosts are local
+// to.  Zones such as the %igb0 of fe80::%igb0/64 are dropped and the <Link#1> rows skipped.
+func Networks(readings []*IFaceReading, interfaces []string) []netip.Prefix {
+	var networks []netip.Prefix
+	for _, r := range readings {
+		if !slices.Contains(interfaces, r.Name) {
+			continue
+		}
+		for _, a := range r.AddressReadings {
+			network := a.Network
+			if zone := strings.IndexByte(network, '%'); zone >= 0 {
+				if length := strings.IndexByte(network, '/'); length > zone {
+					network = network[:zone] + network[length:]
+				}
+			}
+			prefix, err := netip.ParsePrefix(network)
+			if err != nil || slices.Contains(networks, prefix.Masked()) {
+				continue
+			}
+			networks = append(networks, prefix.Masked())
+		}
+	}
+	return networks
 }
 
 func (n *Netstat) TextUIOnce(ctx context.Context) (problem error) {
-	return n.Tick(func(result []*IFaceReading) error {
+	return n.Tick(ctx, func(result []*IFaceReading) error {
 		var addresses []struct {
 			iface string
 			addr  *AddressReading
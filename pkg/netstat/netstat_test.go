@@ -0,0 +1,88 @@
+package netstat
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/engine"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/pfsensetest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunServiceSurvivesFailedReadings(t *testing.T) {
+	interval := tickInterval
+	tickInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		tickInterval = interval
+	})
+	capture, err := os.ReadFile(filepath.Join("testdata", "synthetic-freebsd-14.txt"))
+	require.NoError(t, err)
+
+	// netstat exits with 127 until it is scripted
+	server := pfsensetest.NewServer(t)
+	config := server.Config()
+	n := NewNetstat(&Config{Config: config})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- n.RunService(ctx)
+	}()
+
+	failed := testutil.ToFloat64(failedTicks)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(failedTicks) >= failed+2
+	}, 5*time.Second, 10*time.Millisecond, "failed readings are retried")
+	server.Handle("netstat", pfsensetest.Command{Stdout: strings.Split(strings.TrimSuffix(string(capture), "\n"), "\n")})
+	assert.Eventually(t, func() bool {
+		return testutil.CollectAndCount(n.Collector(), "netstat_nic_bytes_total") > 0
+	}, 5*time.Second, 10*time.Millisecond, "readings are exported once netstat recovers")
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestRunServiceRejectsUnusableConfig(t *testing.T) {
+	server := pfsensetest.NewServer(t)
+	config := server.Config()
+	config.HostKeyFingerprint = ""
+	n := NewNetstat(&Config{Config: config})
+
+	assert.ErrorIs(t, n.RunService(context.Background()), engine.ErrNoHostKeyPolicy)
+	assert.Empty(t, server.Executed())
+}
+
+func TestSurveyLeavesReplayForCollection(t *testing.T) {
+	capture, err := os.ReadFile(filepath.Join("testdata", "synthetic-freebsd-14.txt"))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	var records []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(capture), "\n"), "\n") {
+		record, err := json.Marshal(map[string]string{"at": "2024-03-01T12:00:00Z", "stream": "stdout", "line": line})
+		require.NoError(t, err)
+		records = append(records, string(record))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "netstat-0000000000000000001.jsonl"), []byte(strings.Join(records, "\n")+"\n"), 0644))
+
+	n := NewNetstat(&Config{Config: engine.Config{Transport: engine.TransportReplay, ReplayDir: dir}})
+	surveyed, err := n.Survey(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"igb0", "igb1"}, Interfaces(surveyed))
+
+	var readings []*IFaceReading
+	require.NoError(t, n.Tick(context.Background(), func(reading []*IFaceReading) error {
+		readings = reading
+		return nil
+	}))
+	require.NotEmpty(t, readings)
+	assert.Equal(t, uint64(1), readings[0].Sequence, "surveys are not numbered")
+	assert.ErrorIs(t, n.Tick(context.Background(), func([]*IFaceReading) error {
+		return nil
+	}), engine.ErrReplayExhausted)
+}
@@ -0,0 +1,374 @@
+// Package pfsensetest provides an in-process SSH server impersonating pfSense for end-to-end tests.
+package pfsensetest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"github.com/meschbach/pfsense-bandwidth-tracker/pkg/engine"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	User     = "root"
+	Password = "pfsense"
+)
+
+// Command scripts the output of a program run on the server.
+type Command struct {
+	Stdout []string
+	Stderr []string
+	// Interval is the delay before each line of Stdout.
+	Interval time.Duration
+	// Hold keeps the program running after its output is written until it is signaled or the session is closed, as
+	// iftop does.
+	Hold bool
+	// ExitStatus is reported once the program completes.
+	ExitStatus uint32
+}
+
+// Server is an SSH server serving scripted commands.  Programs without a script exit with status 127.  User is
+// accepted with Password or any key authorized with AuthorizeKey.
+type Server struct {
+	Address            string
+	Port               int
+	HostKeyFingerprint string
+	// MaxSessions rejects sessions beyond this many open on a connection, as OpenSSH's MaxSessions does; unlimited when
+	// zero.  Set before connecting.
+	MaxSessions int
+
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	lock          sync.Mutex
+	commands      map[string]Command
+	authorized    map[string]bool
+	authenticated []string
+	executed      []string
+	signals       []string
+	forwarded     []string
+	connections   int
+	open          map[net.Conn]struct{}
+	running       sync.WaitGroup
+}
+
+// NewServer starts a server on a random local port.  It is stopped when the test completes.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Address:            "127.0.0.1",
+		HostKeyFingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+		commands:           map[string]Command{},
+		authorized:         map[string]bool{},
+		open:               map[net.Conn]struct{}{},
+	}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == User && string(password) == Password {
+				return authenticatedBy("password"), nil
+			}
+			return nil, errors.New("access denied")
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			fingerprint := ssh.FingerprintSHA256(key)
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			if conn.User() == User && s.authorized[fingerprint] {
+				return authenticatedBy(fingerprint), nil
+			}
+			return nil, errors.New("access denied")
+		},
+	}
+	s.config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Port = listener.Addr().(*net.TCPAddr).Port
+	s.listener = listener
+	s.running.Add(1)
+	go s.accept()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Config describes how to reach the server.
+func (s *Server) Config() engine.Config {
+	return engine.Config{
+		Transport:          engine.TransportSSH,
+		PfsenseUser:        User,
+		PfsenseAddress:     s.Address,
+		PfsensePort:        s.Port,
+		PfsensePassword:    Password,
+		HostKeyFingerprint: s.HostKeyFingerprint,
+	}
+}
+
+// authenticatedBy notes how a connection authenticated in its permissions.
+func authenticatedBy(method string) *ssh.Permissions {
+	return &ssh.Permissions{Extensions: map[string]string{"authenticated-by": method}}
+}
+
+// AuthorizeKey accepts key when authenticating as User.
+func (s *Server) AuthorizeKey(key ssh.PublicKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.authorized[ssh.FingerprintSHA256(key)] = true
+}
+
+// Authenticated lists how each connection authenticated: password, or the SHA256 fingerprint of the key.
+func (s *Server) Authenticated() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.authenticated...)
+}
+
+// Handle scripts the output of program.
+func (s *Server) Handle(program string, command Command) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.commands[program] = command
+}
+
+// Executed lists the command lines run so far.
+func (s *Server) Executed() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.executed...)
+}
+
+// Signals lists the signals delivered to running programs.
+func (s *Server) Signals() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.signals...)
+}
+
+// Forwarded lists the addresses connections have been tunneled to.
+func (s *Server) Forwarded() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.forwarded...)
+}
+
+// Connections counts the SSH connections accepted.
+func (s *Server) Connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.connections
+}
+
+// DropConnections abruptly closes every established connection, as a network failure would.
+func (s *Server) DropConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.open {
+		_ = conn.Close()
+	}
+}
+
+// Close stops accepting connections and drops those established.
+func (s *Server) Close() {
+	_ = s.listener.Close()
+	s.running.Wait()
+	s.DropConnections()
+}
+
+func (s *Server) accept() {
+	defer s.running.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	s.lock.Lock()
+	s.open[conn] = struct{}{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.open, conn)
+		s.lock.Unlock()
+	}()
+
+	server, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	defer server.Close()
+	s.lock.Lock()
+	s.connections++
+	s.authenticated = append(s.authenticated, server.Permissions.Extensions["authenticated-by"])
+	s.lock.Unlock()
+
+	go ssh.DiscardRequests(requests)
+	// sessions counts those open on the connection
+	var openLock sync.Mutex
+	open := 0
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "session":
+			openLock.Lock()
+			if s.MaxSessions > 0 && open >= s.MaxSessions {
+				openLock.Unlock()
+				_ = newChannel.Reject(ssh.ResourceShortage, "no more sessions")
+				continue
+			}
+			channel, channelRequests, err := newChannel.Accept()
+			if err != nil {
+				openLock.Unlock()
+				continue
+			}
+			open++
+			openLock.Unlock()
+			go func() {
+				s.session(channel, channelRequests)
+				openLock.Lock()
+				open--
+				openLock.Unlock()
+			}()
+		case "direct-tcpip":
+			go s.forward(newChannel)
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// forward tunnels a connection to another host, allowing the server to act as a jump host.
+func (s *Server) forward(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	address := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	target, err := net.Dial("tcp", address)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = target.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	s.lock.Lock()
+	s.forwarded = append(s.forwarded, address)
+	s.lock.Unlock()
+
+	go func() {
+		_, _ = io.Copy(target, channel)
+		_ = target.Close()
+	}()
+	_, _ = io.Copy(channel, target)
+	_ = channel.Close()
+}
+
+func (s *Server) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	stopped := make(chan struct{})
+	var stop sync.Once
+
+	for request := range requests {
+		switch request.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+				_ = request.Reply(false, nil)
+				continue
+			}
+			_ = request.Reply(true, nil)
+			go s.run(channel, payload.Command, stopped)
+		case "signal":
+			var payload struct{ Signal string }
+			if err := ssh.Unmarshal(request.Payload, &payload); err == nil {
+				s.lock.Lock()
+				s.signals = append(s.signals, payload.Signal)
+				s.lock.Unlock()
+			}
+			stop.Do(func() { close(stopped) })
+		default:
+			if request.WantReply {
+				_ = request.Reply(false, nil)
+			}
+		}
+	}
+	// the client closed the session
+	stop.Do(func() { close(stopped) })
+}
+
+func (s *Server) run(channel ssh.Channel, commandLine string, stopped <-chan struct{}) {
+	s.lock.Lock()
+	s.executed = append(s.executed, commandLine)
+	command, ok := s.commands[program(commandLine)]
+	s.lock.Unlock()
+	if !ok {
+		_, _ = io.WriteString(channel.Stderr(), "command not found\n")
+		s.exit(channel, 127)
+		return
+	}
+
+	for _, line := range command.Stderr {
+		if _, err := io.WriteString(channel.Stderr(), line+"\n"); err != nil {
+			return
+		}
+	}
+	for _, line := range command.Stdout {
+		if command.Interval > 0 {
+			select {
+			case <-time.After(command.Interval):
+			case <-stopped:
+				return
+			}
+		}
+		if _, err := io.WriteString(channel, line+"\n"); err != nil {
+			return
+		}
+	}
+	if command.Hold {
+		<-stopped
+		return
+	}
+	s.exit(channel, command.ExitStatus)
+}
+
+func program(commandLine string) string {
+	fields := strings.Fields(commandLine)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+func (s *Server) exit(channel ssh.Channel, status uint32) {
+	_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+	_ = channel.Close()
+}